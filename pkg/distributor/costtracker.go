@@ -0,0 +1,196 @@
+package distributor
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/util/constants"
+)
+
+// costSampleWindow is the number of recent per-ingester samples the cost
+// tracker keeps in its ring buffer.
+const costSampleWindow = 20
+
+// costEWMAAlpha weights how quickly the EWMA cost estimate reacts to new
+// samples versus its own history.
+const costEWMAAlpha = 0.2
+
+// costTrackerMaxConsecutiveSkips bounds how long an ingester can be
+// skipped back-to-back before shouldSkip forces a re-probe regardless of
+// its cost estimate, so a transient-slow ingester that has since
+// recovered isn't quarantined (and its EWMA frozen at the stale value)
+// forever.
+const costTrackerMaxConsecutiveSkips = 5
+
+// costTracker measures the expense of polling each ingester for its stream
+// rates and uses that history to decide, on each tick, which ingesters are
+// costly enough that the fanout should skip them rather than let one slow
+// peer stall the whole poll.
+type costTracker struct {
+	mu sync.Mutex
+
+	samples map[string][]float64 // addr -> ring buffer of recent cost scores
+	next    map[string]int       // addr -> next write index into samples[addr]
+	ewma    map[string]float64   // addr -> EWMA of cost score
+
+	skipStreak map[string]int // addr -> number of consecutive ticks just skipped
+
+	cost    *prometheus.GaugeVec
+	skipped *prometheus.CounterVec
+}
+
+var (
+	costMetricsOnce sync.Once
+	costGauge       *prometheus.GaugeVec
+	costSkipped     *prometheus.CounterVec
+)
+
+// costTrackerMetrics builds (or, if already built, returns) the cost
+// tracker's collectors, shared process-wide for the same reason as
+// rateStoreMetrics: a single distributor process only ever needs one set,
+// and sharing avoids re-registration when a rateStore is constructed more
+// than once, as tests do.
+func costTrackerMetrics(r prometheus.Registerer) (*prometheus.GaugeVec, *prometheus.CounterVec) {
+	costMetricsOnce.Do(func() {
+		costGauge = promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: constants.Loki,
+			Name:      "distributor_ratestore_ingester_cost",
+			Help:      "The EWMA cost estimate (latency plus payload size) of polling an ingester for stream rates.",
+		}, []string{"ingester"})
+		costSkipped = promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: constants.Loki,
+			Name:      "distributor_ratestore_ingester_skipped_total",
+			Help:      "The number of times an ingester was skipped during a stream rate poll for being too costly relative to its peers.",
+		}, []string{"ingester"})
+	})
+	return costGauge, costSkipped
+}
+
+func newCostTracker(r prometheus.Registerer) *costTracker {
+	cost, skipped := costTrackerMetrics(r)
+	return &costTracker{
+		samples:    map[string][]float64{},
+		next:       map[string]int{},
+		ewma:       map[string]float64{},
+		skipStreak: map[string]int{},
+		cost:       cost,
+		skipped:    skipped,
+	}
+}
+
+// costScore combines latency and response size into a single comparable value,
+// in roughly-millisecond units.
+func costScore(latency time.Duration, bytes int) float64 {
+	return float64(latency.Milliseconds()) + float64(bytes)/1024
+}
+
+// observe records a single request's cost for addr.
+func (c *costTracker) observe(addr string, latency time.Duration, bytes int) {
+	score := costScore(latency, bytes)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := c.samples[addr]
+	if len(buf) < costSampleWindow {
+		buf = append(buf, score)
+	} else {
+		buf[c.next[addr]] = score
+		c.next[addr] = (c.next[addr] + 1) % costSampleWindow
+	}
+	c.samples[addr] = buf
+
+	prev, ok := c.ewma[addr]
+	if !ok {
+		prev = score
+	}
+	c.ewma[addr] = costEWMAAlpha*score + (1-costEWMAAlpha)*prev
+
+	c.cost.WithLabelValues(addr).Set(c.ewma[addr])
+}
+
+// shouldSkip reports whether addr's current cost estimate is far enough
+// above the fleet's mean (mean + k*stddev) that this tick should defer it
+// rather than wait on it. An address that has just been skipped
+// costTrackerMaxConsecutiveSkips times in a row is re-probed regardless of
+// its cost estimate: observe() is the only thing that updates an address's
+// estimate, so without a forced re-probe a genuinely-recovered ingester
+// would stay quarantined on its last (stale, high) estimate forever.
+func (c *costTracker) shouldSkip(addr string, k float64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mean, stddev := c.fleetStatsLocked()
+	score, ok := c.ewma[addr]
+
+	if !ok || stddev == 0 {
+		c.skipStreak[addr] = 0
+		return false
+	}
+
+	skip := score > mean+k*stddev
+	if !skip {
+		c.skipStreak[addr] = 0
+		return false
+	}
+
+	if c.skipStreak[addr] >= costTrackerMaxConsecutiveSkips {
+		c.skipStreak[addr] = 0
+		return false
+	}
+
+	c.skipStreak[addr]++
+	c.skipped.WithLabelValues(addr).Inc()
+	return true
+}
+
+// fleetStatsLocked computes the mean and standard deviation of the cost
+// scores seen across every tracked address, pooling each address's raw
+// ring-buffer samples rather than each address's single EWMA value. A
+// single estimate per address would let one consistently-costly ingester
+// drag the fleet's own mean and stddev up by as much as any other
+// ingester, making it harder for that ingester to ever clear its own
+// threshold; weighting by how often each cost was actually observed
+// keeps the baseline representative of the fleet's typical request cost.
+func (c *costTracker) fleetStatsLocked() (mean, stddev float64) {
+	var sum float64
+	var n int
+	for _, buf := range c.samples {
+		for _, v := range buf {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	mean = sum / float64(n)
+
+	var variance float64
+	for _, buf := range c.samples {
+		for _, v := range buf {
+			d := v - mean
+			variance += d * d
+		}
+	}
+	variance /= float64(n)
+
+	return mean, math.Sqrt(variance)
+}
+
+// Costs returns a point-in-time snapshot of the EWMA cost estimate per
+// ingester address.
+func (c *costTracker) Costs() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]float64, len(c.ewma))
+	for addr, v := range c.ewma {
+		out[addr] = v
+	}
+	return out
+}
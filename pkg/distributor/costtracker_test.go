@@ -0,0 +1,63 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCostTracker(t *testing.T) {
+	t.Run("it reports no cost for an ingester it has never seen", func(t *testing.T) {
+		c := newCostTracker(prometheus.NewRegistry())
+		require.Empty(t, c.Costs())
+		require.False(t, c.shouldSkip("ingester0", 2))
+	})
+
+	t.Run("it skips an ingester whose cost is far above its peers", func(t *testing.T) {
+		c := newCostTracker(prometheus.NewRegistry())
+
+		for i := 0; i < costSampleWindow; i++ {
+			c.observe("ingester0", 5*time.Millisecond, 100)
+			c.observe("ingester1", 5*time.Millisecond, 100)
+			c.observe("ingester2", 5*time.Millisecond, 100)
+		}
+		c.observe("ingester3", 500*time.Millisecond, 100)
+
+		require.False(t, c.shouldSkip("ingester0", 2))
+		require.True(t, c.shouldSkip("ingester3", 2))
+	})
+
+	t.Run("it forces a re-probe after enough consecutive skips instead of quarantining an ingester forever", func(t *testing.T) {
+		c := newCostTracker(prometheus.NewRegistry())
+
+		for i := 0; i < costSampleWindow; i++ {
+			c.observe("ingester0", 5*time.Millisecond, 100)
+			c.observe("ingester1", 5*time.Millisecond, 100)
+		}
+		c.observe("ingester2", 500*time.Millisecond, 100)
+
+		for i := 0; i < costTrackerMaxConsecutiveSkips; i++ {
+			require.True(t, c.shouldSkip("ingester2", 2), "tick %d should still be skipped", i)
+		}
+		require.False(t, c.shouldSkip("ingester2", 2), "the streak should force a re-probe once the limit is reached")
+
+		// Enough re-probes confirming the ingester has actually recovered
+		// should let its EWMA decay back down and stop tripping shouldSkip,
+		// rather than it staying skipped on the strength of one old sample.
+		for i := 0; i < costSampleWindow; i++ {
+			c.observe("ingester2", 5*time.Millisecond, 100)
+		}
+		require.False(t, c.shouldSkip("ingester2", 2))
+	})
+
+	t.Run("Costs returns a snapshot of current estimates", func(t *testing.T) {
+		c := newCostTracker(prometheus.NewRegistry())
+		c.observe("ingester0", 10*time.Millisecond, 0)
+
+		costs := c.Costs()
+		require.Contains(t, costs, "ingester0")
+		require.Greater(t, costs["ingester0"], 0.0)
+	})
+}
@@ -0,0 +1,37 @@
+package distributor
+
+import (
+	"github.com/grafana/loki/pkg/distributor/shardstreams"
+)
+
+// WriteLimiter is the rate-enforcement surface a write path calls once per
+// incoming stream before forwarding it to ingesters: a RateStore to check
+// the stream's budget against, and (once sharding is enabled for the
+// tenant) a WindowedRateStore to size shards from.
+//
+// Nothing in this package tree has a Distributor.Push to call it from yet —
+// that type doesn't exist here — so CheckStream currently has no caller
+// outside its own tests. It's kept as the single chokepoint a future Push
+// implementation should call, rather than duplicated ad hoc at whatever
+// call site eventually needs it.
+type WriteLimiter struct {
+	Rates    RateStore
+	Windows  *WindowedRateStore
+	ShardCfg shardstreams.Config
+}
+
+// CheckStream enforces streamHashNoShard's rate budget via CheckRate and,
+// if the stream is allowed, returns how many shards it should be split
+// into. It returns ErrStreamRateLimited (via CheckRate) when the stream or
+// its tenant is over budget. Shards defaults to 1 when w has no
+// WindowedRateStore configured, e.g. because sharding is disabled.
+func (w WriteLimiter) CheckStream(tenant string, streamHashNoShard uint64) (shards int, err error) {
+	if _, err := CheckRate(w.Rates, tenant, streamHashNoShard); err != nil {
+		return 0, err
+	}
+
+	if w.Windows == nil {
+		return 1, nil
+	}
+	return w.Windows.ShardCountFor(w.ShardCfg, streamHashNoShard), nil
+}
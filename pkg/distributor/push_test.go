@@ -0,0 +1,51 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/distributor/shardstreams"
+)
+
+type fakeRateStore struct {
+	rate    int64
+	allowed bool
+}
+
+func (f *fakeRateStore) RateFor(_ string, _ uint64) (int64, bool) {
+	return f.rate, f.allowed
+}
+
+func TestWriteLimiter_CheckStream(t *testing.T) {
+	t.Run("rejects a stream over its rate budget", func(t *testing.T) {
+		w := WriteLimiter{Rates: &fakeRateStore{rate: 100, allowed: false}}
+
+		_, err := w.CheckStream(fakeTenant, 0)
+		require.ErrorIs(t, err, ErrStreamRateLimited)
+	})
+
+	t.Run("defaults to a single shard without a WindowedRateStore", func(t *testing.T) {
+		w := WriteLimiter{Rates: &fakeRateStore{allowed: true}}
+
+		shards, err := w.CheckStream(fakeTenant, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, shards)
+	})
+
+	t.Run("sizes shards from the windowed P95 once sharding is configured", func(t *testing.T) {
+		source := &fakeRateSource{rates: map[uint64]int64{0: 9 << 20}}
+		windows := NewWindowedRateStore(RateStoreConfig{StreamRateUpdateInterval: 1}, source)
+		require.NoError(t, windows.sample(nil))
+
+		w := WriteLimiter{
+			Rates:    &fakeRateStore{allowed: true},
+			Windows:  windows,
+			ShardCfg: shardstreams.Config{Enabled: true, DesiredRate: 3 << 20},
+		}
+
+		shards, err := w.CheckStream(fakeTenant, 0)
+		require.NoError(t, err)
+		require.Equal(t, 3, shards)
+	})
+}
@@ -0,0 +1,653 @@
+package distributor
+
+import (
+	"context"
+	"flag"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/ring"
+	ring_client "github.com/grafana/dskit/ring/client"
+	"github.com/grafana/dskit/services"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
+
+	ratestorekv "github.com/grafana/loki/pkg/distributor/ratestore/kv"
+	ingester_client "github.com/grafana/loki/pkg/ingester/client"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/util/constants"
+	"github.com/grafana/loki/pkg/validation"
+)
+
+// The RateStore backends selectable via RateStoreConfig.Backend.
+const (
+	RateStoreBackendLocal = "local"
+	RateStoreBackendKV    = "kv"
+)
+
+// ErrStreamRateLimited is returned by CheckRate when a stream (or its
+// tenant) has exceeded its configured rate budget.
+var ErrStreamRateLimited = errors.New("stream rate limit exceeded")
+
+// Limits is the subset of validation overrides the rate store needs in
+// order to decide which tenants have sharding (and rate enforcement)
+// enabled, and what budget to enforce it with.
+type Limits interface {
+	AllByUserID() map[string]*validation.Limits
+}
+
+// poolClientFactory is satisfied by ring_client.Pool; narrowed here so tests
+// can provide a fake.
+type poolClientFactory interface {
+	GetClientFor(addr string) (ring_client.PoolClient, error)
+}
+
+type RateStoreConfig struct {
+	MaxParallelism           int           `yaml:"max_request_parallelism"`
+	IngesterReqTimeout       time.Duration `yaml:"ingester_request_timeout"`
+	StreamRateUpdateInterval time.Duration `yaml:"stream_rate_update_interval"`
+
+	// CostTrackerStdDevMultiplier is the k in mean+k*stddev: an ingester
+	// whose EWMA poll cost exceeds that threshold is skipped for the tick
+	// rather than blocking the rest of the fanout.
+	CostTrackerStdDevMultiplier float64 `yaml:"cost_tracker_stddev_multiplier"`
+
+	// Backend selects how distributors obtain stream rates: "local" (the
+	// default) has every distributor poll every ingester directly; "kv"
+	// shares locally observed rates between distributors through a KV
+	// store so the polling work can be split up between them.
+	Backend string             `yaml:"backend"`
+	KVStore ratestorekv.Config `yaml:"kv_store"`
+
+	// UseStreaming switches to a long-lived, server-streaming RPC for
+	// fetching stream rates instead of polling ingesters with a unary
+	// request every StreamRateUpdateInterval. It defaults to false so
+	// distributors keep working against ingesters that haven't rolled out
+	// the streaming RPC yet.
+	UseStreaming bool `yaml:"use_streaming"`
+
+	// RateWindow is the span of history a WindowedRateStore keeps per
+	// stream. Together with StreamRateUpdateInterval it determines how many
+	// samples are retained.
+	RateWindow time.Duration `yaml:"rate_window"`
+
+	// StreamRateRetentionPeriod bounds the memory used to track per-stream
+	// state: a WindowedRateStore's window for a stream is dropped once it
+	// hasn't been sampled for this long, and likewise a rateStore's
+	// per-stream (and per-tenant) rate-limit bucket is dropped once RateFor
+	// hasn't been asked about it for this long.
+	StreamRateRetentionPeriod time.Duration `yaml:"stream_rate_retention_period"`
+}
+
+func (cfg *RateStoreConfig) RegisterFlagsWithPrefix(prefix string, fs *flag.FlagSet) {
+	fs.IntVar(&cfg.MaxParallelism, prefix+"rate-store.max-request-parallelism", 200, "The max number of concurrent requests to make to ingesters when computing stream rates.")
+	fs.DurationVar(&cfg.IngesterReqTimeout, prefix+"rate-store.ingester-request-timeout", 500*time.Millisecond, "The timeout for a single ingester's stream rate request.")
+	fs.DurationVar(&cfg.StreamRateUpdateInterval, prefix+"rate-store.stream-rate-update-interval", time.Second, "The interval on which distributors will update current stream rates from ingesters.")
+	fs.Float64Var(&cfg.CostTrackerStdDevMultiplier, prefix+"rate-store.cost-tracker-stddev-multiplier", 2, "The number of standard deviations above the mean ingester poll cost before that ingester is skipped for a tick.")
+	fs.StringVar(&cfg.Backend, prefix+"rate-store.backend", RateStoreBackendLocal, "Backend for distributor stream rates: 'local' or 'kv'.")
+	cfg.KVStore.RegisterFlagsWithPrefix(prefix+"rate-store.", fs)
+	fs.BoolVar(&cfg.UseStreaming, prefix+"rate-store.use-streaming", false, "Use a long-lived streaming RPC to fetch stream rates from ingesters instead of polling with a unary request on every tick.")
+	fs.DurationVar(&cfg.RateWindow, prefix+"rate-store.rate-window", 5*time.Minute, "The span of history a windowed rate store keeps per stream, used to compute sliding-window shard decisions.")
+	fs.DurationVar(&cfg.StreamRateRetentionPeriod, prefix+"rate-store.stream-rate-retention-period", 10*time.Minute, "How long a windowed rate store keeps a stream's history, or a rate store keeps a stream's or tenant's rate-limit bucket, after it was last used.")
+}
+
+// RateStore aggregates the rates reported by ingesters per stream, and
+// decides whether a stream's (or tenant's) rate stays within its
+// configured budget.
+type RateStore interface {
+	RateFor(tenant string, streamHashNoShard uint64) (rate int64, allowed bool)
+}
+
+type rateStore struct {
+	services.Service
+
+	ring                        ring.ReadRing
+	clientPool                  poolClientFactory
+	overrides                   Limits
+	logger                      log.Logger
+	maxParallelism              int
+	ingesterTimeout             time.Duration
+	costTrackerStdDevMultiplier float64
+	useStreaming                bool
+
+	costs  *costTracker
+	stream *streamingPoller
+
+	rateLock sync.RWMutex
+	rates    map[uint64]map[uint64]map[string]int64 // streamHashNoShard -> StreamHash (shard) -> ingester addr -> rate
+
+	bucketLock      sync.Mutex
+	streamBuckets   map[uint64]*tokenBucket // streamHashNoShard -> per-stream budget
+	tenantBuckets   map[string]*tokenBucket // tenant -> aggregate budget
+	bucketRetention time.Duration           // how long an unused bucket is kept before eviction
+
+	metrics *rateStoreMetrics
+}
+
+type rateStoreMetrics struct {
+	streamRate      *prometheus.GaugeVec
+	streamTokens    *prometheus.GaugeVec
+	rejectedStreams *prometheus.CounterVec
+}
+
+var (
+	rateStoreMetricsOnce   sync.Once
+	sharedRateStoreMetrics *rateStoreMetrics
+)
+
+// newRateStoreMetrics builds (or, if already built, returns) the rate
+// store's collectors. They're shared process-wide rather than per-instance
+// since a distributor only ever runs one rateStore at a time, and sharing
+// keeps repeated construction (as in tests) from re-registering the same
+// metric names.
+func newRateStoreMetrics(r prometheus.Registerer) *rateStoreMetrics {
+	rateStoreMetricsOnce.Do(func() {
+		sharedRateStoreMetrics = &rateStoreMetrics{
+			streamRate: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: constants.Loki,
+				Name:      "distributor_stream_rate_bytes",
+				Help:      "The last reported rate, in bytes/sec, for a stream, aggregated over all replicas and shards.",
+			}, []string{"stream_hash"}),
+			streamTokens: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: constants.Loki,
+				Name:      "distributor_stream_rate_tokens_remaining",
+				Help:      "The number of tokens remaining in a stream's rate-limit bucket.",
+			}, []string{"stream_hash"}),
+			rejectedStreams: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+				Namespace: constants.Loki,
+				Name:      "distributor_stream_rate_rejected_total",
+				Help:      "The number of times a stream has been rejected for exceeding its rate budget.",
+			}, []string{"tenant", "reason"}),
+		}
+	})
+	return sharedRateStoreMetrics
+}
+
+func NewRateStore(cfg RateStoreConfig, r ring.ReadRing, cf poolClientFactory, o Limits, reg prometheus.Registerer, logger log.Logger) *rateStore {
+	stdDevMultiplier := cfg.CostTrackerStdDevMultiplier
+	if stdDevMultiplier <= 0 {
+		stdDevMultiplier = 2
+	}
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	s := &rateStore{
+		ring:                        r,
+		clientPool:                  cf,
+		overrides:                   o,
+		logger:                      logger,
+		maxParallelism:              cfg.MaxParallelism,
+		ingesterTimeout:             cfg.IngesterReqTimeout,
+		costTrackerStdDevMultiplier: stdDevMultiplier,
+		useStreaming:                cfg.UseStreaming,
+		costs:                       newCostTracker(reg),
+		rates:                       map[uint64]map[uint64]map[string]int64{},
+		streamBuckets:               map[uint64]*tokenBucket{},
+		tenantBuckets:               map[string]*tokenBucket{},
+		bucketRetention:             cfg.StreamRateRetentionPeriod,
+		metrics:                     newRateStoreMetrics(reg),
+	}
+	if cfg.UseStreaming {
+		s.stream = newStreamingPoller(cf, logger, cfg.StreamRateRetentionPeriod, reg)
+	}
+	s.Service = services.NewTimerService(cfg.StreamRateUpdateInterval, nil, s.updateAllRates, s.stopping)
+	return s
+}
+
+func (s *rateStore) stopping(_ error) error {
+	if s.stream != nil {
+		s.stream.stop()
+	}
+	return nil
+}
+
+// NewConfiguredRateStore builds the RateStore selected by cfg.Backend. The
+// "kv" backend still builds a local *rateStore to do the actual ingester
+// polling and per-tenant budget enforcement; the KV layer only changes
+// which ingesters this replica polls and which rate it sees per stream.
+func NewConfiguredRateStore(cfg RateStoreConfig, replicaID string, r ring.ReadRing, cf poolClientFactory, o Limits, reg prometheus.Registerer, logger log.Logger) (RateStore, error) {
+	local := NewRateStore(cfg, r, cf, o, reg, logger)
+
+	if cfg.Backend != RateStoreBackendKV {
+		return local, nil
+	}
+
+	return ratestorekv.NewRateStore(cfg.KVStore, replicaID, local, reg, logger)
+}
+
+// Costs returns the current per-ingester cost estimates used to decide
+// which ingesters get skipped on a given poll tick.
+func (s *rateStore) Costs() map[string]float64 {
+	return s.costs.Costs()
+}
+
+// HealthyInstances returns the ingesters currently known to be healthy,
+// for callers (such as the KV-backed RateStore) that partition the
+// polling work across distributor replicas themselves.
+func (s *rateStore) HealthyInstances() ([]ring.InstanceDesc, error) {
+	set, err := s.ring.GetAllHealthy(ring.Read)
+	if err != nil {
+		return nil, err
+	}
+	return set.Instances, nil
+}
+
+// PollInstances polls exactly the given ingesters for their stream rates
+// and returns the per-stream rate reported by each, keyed by the shard
+// (StreamHash) it was reported under and then by ingester address. Both
+// levels of the breakdown are preserved (rather than reduced to a single
+// value here) so that callers merging this replica's view with others',
+// such as the KV-backed RateStore, can still tell which shard and which
+// address contributed a rate before doing their own reduction; collapsing
+// either level here would make it impossible to distinguish a distinct
+// shard (which must be summed) from a replica of one already counted
+// (which must be deduplicated by taking the max). It does not update the
+// store's own view; callers that want the result reflected in RateFor must
+// pass it to ApplyRates.
+func (s *rateStore) PollInstances(ctx context.Context, instances []ring.InstanceDesc) map[uint64]map[uint64]map[string]int64 {
+	return s.instanceRates(ctx, instances)
+}
+
+// ApplyRates replaces the store's current view with an externally computed
+// per-stream, per-shard, per-address rate breakdown (for example, rates
+// merged from peer distributors via a shared KV store) and refreshes the
+// rate-limit buckets to match. The breakdown is kept as-is, rather than
+// flattened to a single rate per stream, so that the next poll's
+// carryForwardRates can still find a given address's last known
+// contribution to a given shard.
+func (s *rateStore) ApplyRates(rates map[uint64]map[uint64]map[string]int64) {
+	s.rateLock.Lock()
+	s.rates = rates
+	s.rateLock.Unlock()
+
+	s.updateBuckets(rates)
+}
+
+// RatesSnapshot returns the current aggregate rate per stream, for callers
+// (such as a WindowedRateStore) that want to sample the store's view on
+// their own schedule rather than through RateFor.
+func (s *rateStore) RatesSnapshot() map[uint64]int64 {
+	s.rateLock.RLock()
+	defer s.rateLock.RUnlock()
+
+	out := make(map[uint64]int64, len(s.rates))
+	for hash, byShard := range s.rates {
+		out[hash] = sumRates(byShard)
+	}
+	return out
+}
+
+// anyRateLimitingEnabled reports whether polling ingesters for stream rates
+// would do anything useful: either some tenant has sharding enabled (which
+// needs rates to size shards), or some tenant has a per-stream or per-tenant
+// rate limit configured (which needs rates to debit the token buckets
+// RateFor and CheckRate read from). Gating updateAllRates on sharding alone
+// left those buckets created full and never debited for a cluster running
+// rate limiting without sharding.
+func (s *rateStore) anyRateLimitingEnabled() bool {
+	for _, lim := range s.overrides.AllByUserID() {
+		if lim.ShardStreams != nil && lim.ShardStreams.Enabled {
+			return true
+		}
+		if int64(lim.PerStreamRateLimit) > 0 || lim.IngestionRateMB > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *rateStore) updateAllRates(ctx context.Context) error {
+	if !s.anyRateLimitingEnabled() {
+		return nil
+	}
+
+	replicationSet, err := s.ring.GetAllHealthy(ring.Read)
+	if err != nil {
+		level.Error(s.logger).Log("msg", "unable to read ring to fetch ingester stream rates", "err", err)
+		return nil
+	}
+
+	var rates map[uint64]map[uint64]map[string]int64
+	if s.useStreaming {
+		s.stream.ensureStreams(replicationSet.Instances)
+		rates = s.stream.Snapshot()
+	} else {
+		rates = s.instanceRates(ctx, replicationSet.Instances)
+	}
+
+	s.rateLock.Lock()
+	s.rates = rates
+	s.rateLock.Unlock()
+
+	s.updateBuckets(rates)
+
+	return nil
+}
+
+func (s *rateStore) instanceRates(ctx context.Context, instances []ring.InstanceDesc) map[uint64]map[uint64]map[string]int64 {
+	s.rateLock.RLock()
+	previous := s.rates
+	s.rateLock.RUnlock()
+
+	rates := map[uint64]map[uint64]map[string]int64{}
+	var mtx sync.Mutex
+
+	setRate := func(hash, shard uint64, addr string, rate int64) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if _, ok := rates[hash]; !ok {
+			rates[hash] = map[uint64]map[string]int64{}
+		}
+		if _, ok := rates[hash][shard]; !ok {
+			rates[hash][shard] = map[string]int64{}
+		}
+		rates[hash][shard][addr] += rate
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.maxParallelism)
+
+	for _, instance := range instances {
+		instance := instance
+
+		if s.costs.shouldSkip(instance.Addr, s.costTrackerStdDevMultiplier) {
+			level.Debug(s.logger).Log("msg", "deferring costly ingester to a later tick", "ingester", instance.Addr)
+			carryForwardRates(previous, instance.Addr, setRate)
+			continue
+		}
+
+		g.Go(func() error {
+			reqCtx, cancel := context.WithTimeout(ctx, s.ingesterTimeout)
+			defer cancel()
+
+			start := time.Now()
+			resp, err := s.rateForInstance(reqCtx, instance)
+			s.costs.observe(instance.Addr, time.Since(start), responseSize(resp))
+
+			if err != nil {
+				level.Error(s.logger).Log("msg", "unable to get stream rates", "ingester", instance.Addr, "err", err)
+				carryForwardRates(previous, instance.Addr, setRate)
+				return nil
+			}
+
+			for _, rate := range resp.StreamRates {
+				setRate(rate.StreamHashNoShard, rate.StreamHash, instance.Addr, rate.Rate)
+			}
+			return nil
+		})
+	}
+
+	// Errors from individual ingesters are logged and swallowed above so one
+	// unhealthy or costly ingester can't stall the whole poll.
+	_ = g.Wait()
+
+	return rates
+}
+
+// carryForwardRates preserves addr's last known contribution to every
+// shard it previously reported when a tick skips or fails to reach that
+// ingester, so a single bad ingester doesn't make its streams appear to go
+// idle.
+func carryForwardRates(previous map[uint64]map[uint64]map[string]int64, addr string, setRate func(hash, shard uint64, addr string, rate int64)) {
+	for hash, byShard := range previous {
+		for shard, byAddr := range byShard {
+			if rate, ok := byAddr[addr]; ok {
+				setRate(hash, shard, addr, rate)
+			}
+		}
+	}
+}
+
+func responseSize(resp *logproto.StreamRatesResponse) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.Size()
+}
+
+func (s *rateStore) rateForInstance(ctx context.Context, instance ring.InstanceDesc) (*logproto.StreamRatesResponse, error) {
+	client, err := s.clientPool.GetClientFor(instance.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	streamClient, ok := client.(ingester_client.HealthAndIngesterClient)
+	if !ok {
+		return nil, errors.Errorf("client for %s does not support stream rates", instance.Addr)
+	}
+
+	return streamClient.GetStreamRates(ctx, &logproto.StreamRatesRequest{})
+}
+
+// RateFor returns the current aggregate rate for a stream, along with
+// whether the stream (or its tenant) is still within its configured
+// budget. Callers on the write path should reject the stream when allowed
+// is false.
+func (s *rateStore) RateFor(tenant string, streamHashNoShard uint64) (int64, bool) {
+	s.rateLock.RLock()
+	rate := sumRates(s.rates[streamHashNoShard])
+	s.rateLock.RUnlock()
+
+	streamBucket := s.bucketFor(s.streamBuckets, streamHashNoShard, tenant, s.perStreamLimits)
+	tenantBucket := s.bucketForTenant(tenant)
+
+	streamAllowed := streamBucket == nil || streamBucket.allowed()
+	tenantAllowed := tenantBucket == nil || tenantBucket.allowed()
+
+	allowed := streamAllowed && tenantAllowed
+	if !allowed {
+		reason := "stream"
+		if !tenantAllowed {
+			reason = "tenant"
+		}
+		s.metrics.rejectedStreams.WithLabelValues(tenant, reason).Inc()
+	}
+
+	return rate, allowed
+}
+
+// CheckRate adapts a RateStore's RateFor into the structured error the
+// write path is expected to act on: it returns ErrStreamRateLimited when
+// the stream (or its tenant) is over budget, and nil otherwise, so a
+// caller on the Push path can reject the offending stream instead of
+// silently accepting it.
+func CheckRate(rs RateStore, tenant string, streamHashNoShard uint64) (int64, error) {
+	rate, allowed := rs.RateFor(tenant, streamHashNoShard)
+	if !allowed {
+		return rate, ErrStreamRateLimited
+	}
+	return rate, nil
+}
+
+// sumRates reduces a stream's per-shard, per-address rate breakdown to a
+// single aggregate: the max across the addresses reporting each shard (so
+// RF>1 replicas of the same shard aren't double-counted), summed across
+// shards (since a stream split across shards by the write path really is
+// receiving all of their rates at once).
+func sumRates(byShard map[uint64]map[string]int64) int64 {
+	var sum int64
+	for _, byAddr := range byShard {
+		var max int64
+		for _, rate := range byAddr {
+			if rate > max {
+				max = rate
+			}
+		}
+		sum += max
+	}
+	return sum
+}
+
+func (s *rateStore) perStreamLimits(tenant string) (capacity, refill int64) {
+	lim, ok := s.overrides.AllByUserID()[tenant]
+	if !ok || int64(lim.PerStreamRateLimit) <= 0 {
+		return 0, 0
+	}
+	return int64(lim.PerStreamRateLimitBurst), int64(lim.PerStreamRateLimit)
+}
+
+func (s *rateStore) tenantLimits(tenant string) (capacity, refill int64) {
+	lim, ok := s.overrides.AllByUserID()[tenant]
+	if !ok || lim.IngestionRateMB <= 0 {
+		return 0, 0
+	}
+	return int64(lim.IngestionBurstSizeMB * (1 << 20)), int64(lim.IngestionRateMB * (1 << 20))
+}
+
+func (s *rateStore) bucketFor(buckets map[uint64]*tokenBucket, hash uint64, tenant string, limitsFn func(string) (int64, int64)) *tokenBucket {
+	capacity, refill := limitsFn(tenant)
+	if refill <= 0 {
+		return nil
+	}
+
+	s.bucketLock.Lock()
+	defer s.bucketLock.Unlock()
+
+	b, ok := buckets[hash]
+	if !ok {
+		b = newTokenBucket(capacity, refill)
+		buckets[hash] = b
+	}
+	b.touch()
+	return b
+}
+
+func (s *rateStore) bucketForTenant(tenant string) *tokenBucket {
+	capacity, refill := s.tenantLimits(tenant)
+	if refill <= 0 {
+		return nil
+	}
+
+	s.bucketLock.Lock()
+	defer s.bucketLock.Unlock()
+
+	b, ok := s.tenantBuckets[tenant]
+	if !ok {
+		b = newTokenBucket(capacity, refill)
+		s.tenantBuckets[tenant] = b
+	}
+	b.touch()
+	return b
+}
+
+// updateBuckets debits every tracked bucket by the most recently observed
+// rate for its stream, so RateFor can make an allow/deny decision without
+// doing any network or locking work on the request path. It also evicts
+// buckets that RateFor hasn't touched for bucketRetention, so a
+// distributor that's been up for a long time doesn't keep a token bucket
+// alive forever for every streamHashNoShard it has ever seen.
+func (s *rateStore) updateBuckets(rates map[uint64]map[uint64]map[string]int64) {
+	s.bucketLock.Lock()
+	defer s.bucketLock.Unlock()
+
+	for hash, bucket := range s.streamBuckets {
+		observed := sumRates(rates[hash])
+		bucket.observe(observed)
+		s.metrics.streamRate.WithLabelValues(hashLabel(hash)).Set(float64(observed))
+		s.metrics.streamTokens.WithLabelValues(hashLabel(hash)).Set(bucket.remaining())
+	}
+
+	s.evictStaleBucketsLocked()
+}
+
+// evictStaleBucketsLocked drops any stream or tenant bucket that hasn't
+// been touched by RateFor in bucketRetention. Callers must hold
+// bucketLock.
+func (s *rateStore) evictStaleBucketsLocked() {
+	if s.bucketRetention <= 0 {
+		return
+	}
+
+	for hash, bucket := range s.streamBuckets {
+		if bucket.idleFor() > s.bucketRetention {
+			delete(s.streamBuckets, hash)
+			s.metrics.streamRate.DeleteLabelValues(hashLabel(hash))
+			s.metrics.streamTokens.DeleteLabelValues(hashLabel(hash))
+		}
+	}
+
+	for tenant, bucket := range s.tenantBuckets {
+		if bucket.idleFor() > s.bucketRetention {
+			delete(s.tenantBuckets, tenant)
+		}
+	}
+}
+
+func hashLabel(hash uint64) string {
+	return strconv.FormatUint(hash, 10)
+}
+
+// tokenBucket is a simple token bucket keyed to wall-clock time. capacity
+// and refill are both expressed in the same unit as the values passed to
+// observe (bytes/sec for stream and tenant rate budgets).
+type tokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	refill   float64 // tokens added per second
+	last     time.Time
+	ok       bool
+	touched  time.Time // last time RateFor looked this bucket up
+}
+
+func newTokenBucket(capacity, refill int64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		refill:   float64(refill),
+		last:     now,
+		ok:       true,
+		touched:  now,
+	}
+}
+
+// touch records that RateFor just looked this bucket up, so
+// evictStaleBucketsLocked knows it's still in use.
+func (b *tokenBucket) touch() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.touched = time.Now()
+}
+
+// idleFor reports how long it's been since a caller last looked this
+// bucket up via touch.
+func (b *tokenBucket) idleFor() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Since(b.touched)
+}
+
+// observe debits the bucket by the currently observed rate for the period
+// since the last observation, after refilling for elapsed time.
+func (b *tokenBucket) observe(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.refill)
+	b.tokens -= float64(rate) * elapsed
+	b.ok = b.tokens >= 0
+}
+
+func (b *tokenBucket) allowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ok
+}
+
+func (b *tokenBucket) remaining() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
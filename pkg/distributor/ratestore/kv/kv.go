@@ -0,0 +1,250 @@
+// Package kv implements a RateStore backend that shares per-stream rate
+// aggregations between distributor replicas through a dskit/kv store,
+// rather than every distributor independently polling every ingester.
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/services"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config configures the KV-backed RateStore.
+type Config struct {
+	KVStore      kv.Config     `yaml:"kvstore"`
+	PushInterval time.Duration `yaml:"push_interval"`
+}
+
+func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	cfg.KVStore.RegisterFlagsWithPrefix(prefix, "collectors/", f)
+	f.DurationVar(&cfg.PushInterval, prefix+"push-interval", time.Second, "How often a distributor publishes its locally observed stream rates to the shared ratestore KV store.")
+}
+
+const keyPrefix = "ratestore/"
+
+// LocalSource is satisfied by the direct-poll distributor rateStore. It
+// lets the KV-backed store reuse the existing ingester-fanout machinery
+// (including its cost-aware skipping and per-tenant budget enforcement)
+// while only asking it to poll the subset of ingesters this replica owns.
+type LocalSource interface {
+	HealthyInstances() ([]ring.InstanceDesc, error)
+	PollInstances(ctx context.Context, instances []ring.InstanceDesc) map[uint64]map[uint64]map[string]int64
+	ApplyRates(rates map[uint64]map[uint64]map[string]int64)
+	RateFor(tenant string, streamHashNoShard uint64) (int64, bool)
+}
+
+// RateStore shares per-stream rate aggregations between distributor
+// replicas through a KV store: each replica polls only the ingesters it
+// owns (decided by rendezvous hashing over the set of replicas visible in
+// the store) and merges in whatever its peers have published, so N
+// distributors do O(ingesters) total fanout rather than O(N*ingesters).
+// If the KV store is unreachable, it falls back to polling every ingester
+// itself for that tick.
+type RateStore struct {
+	services.Service
+
+	replicaID string
+	local     LocalSource
+	client    kv.Client
+	logger    log.Logger
+}
+
+func NewRateStore(cfg Config, replicaID string, local LocalSource, reg prometheus.Registerer, logger log.Logger) (*RateStore, error) {
+	client, err := kv.NewClient(cfg.KVStore, snapshotCodec{}, reg, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating ratestore kv client")
+	}
+
+	s := &RateStore{
+		replicaID: replicaID,
+		local:     local,
+		client:    client,
+		logger:    logger,
+	}
+	s.Service = services.NewTimerService(cfg.PushInterval, nil, s.tick, nil)
+	return s, nil
+}
+
+func (s *RateStore) tick(ctx context.Context) error {
+	instances, err := s.local.HealthyInstances()
+	if err != nil {
+		level.Error(s.logger).Log("msg", "unable to list healthy ingesters", "err", err)
+		return nil
+	}
+
+	peers, err := s.peers(ctx)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "ratestore kv store unavailable, falling back to direct polling of all ingesters", "err", err)
+		s.local.ApplyRates(s.local.PollInstances(ctx, instances))
+		return nil
+	}
+
+	owned := ownedInstances(instances, peers, s.replicaID)
+	localRates := s.local.PollInstances(ctx, owned)
+
+	if err := s.publish(ctx, localRates); err != nil {
+		level.Warn(s.logger).Log("msg", "unable to publish local stream rates to kv store", "err", err)
+	}
+
+	merged, err := s.mergePeers(ctx, peers)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "unable to read peer stream rates from kv store, falling back to direct polling of all ingesters", "err", err)
+		s.local.ApplyRates(s.local.PollInstances(ctx, instances))
+		return nil
+	}
+
+	s.local.ApplyRates(merged)
+	return nil
+}
+
+// peers returns the sorted set of replica IDs currently known to the KV
+// store, always including this replica's own ID.
+func (s *RateStore) peers(ctx context.Context) ([]string, error) {
+	keys, err := s.client.List(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{s.replicaID: {}}
+	for _, key := range keys {
+		seen[strings.TrimPrefix(key, keyPrefix)] = struct{}{}
+	}
+
+	peers := make([]string, 0, len(seen))
+	for id := range seen {
+		peers = append(peers, id)
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+func (s *RateStore) publish(ctx context.Context, rates map[uint64]map[uint64]map[string]int64) error {
+	return s.client.CAS(ctx, keyPrefix+s.replicaID, func(interface{}) (interface{}, bool, error) {
+		return rates, true, nil
+	})
+}
+
+// mergePeers combines every peer's published per-shard, per-address rates
+// into a single view, keyed by stream, then by the shard (StreamHash) it
+// was reported under, then by the ingester address that contributed the
+// rate. ownedInstances partitions ingesters disjointly across peers, so in
+// steady state no address is published by more than one peer for a given
+// shard; during a handoff two peers can transiently publish the same
+// shard/address pair, which is resolved here by keeping the higher of the
+// two rather than double-counting it. The result still has one entry per
+// contributing shard and address rather than a single per-stream scalar;
+// the caller passes it straight to ApplyRates, which (via the local
+// backend's sumRates) takes the max across addresses reporting the same
+// shard and sums across distinct shards, the same reduction the local
+// backend and the direct-poll fallbacks use.
+func (s *RateStore) mergePeers(ctx context.Context, peers []string) (map[uint64]map[uint64]map[string]int64, error) {
+	merged := map[uint64]map[uint64]map[string]int64{}
+	for _, peer := range peers {
+		v, err := s.client.Get(ctx, keyPrefix+peer)
+		if err != nil {
+			return nil, err
+		}
+		rates, ok := v.(map[uint64]map[uint64]map[string]int64)
+		if !ok {
+			continue
+		}
+		for hash, byShard := range rates {
+			if _, ok := merged[hash]; !ok {
+				merged[hash] = map[uint64]map[string]int64{}
+			}
+			for shard, byAddr := range byShard {
+				if _, ok := merged[hash][shard]; !ok {
+					merged[hash][shard] = map[string]int64{}
+				}
+				for addr, rate := range byAddr {
+					if rate > merged[hash][shard][addr] {
+						merged[hash][shard][addr] = rate
+					}
+				}
+			}
+		}
+	}
+	return merged, nil
+}
+
+// ownedInstances partitions instances across peers using rendezvous
+// (highest random weight) hashing: each instance is polled by exactly one
+// peer, the assignment is stable as peers come and go, and no coordinator
+// is required for replicas to converge on the same partitioning.
+func ownedInstances(instances []ring.InstanceDesc, peers []string, self string) []ring.InstanceDesc {
+	owned := make([]ring.InstanceDesc, 0, len(instances))
+	for _, inst := range instances {
+		if owner(inst.Addr, peers) == self {
+			owned = append(owned, inst)
+		}
+	}
+	return owned
+}
+
+func owner(addr string, peers []string) string {
+	var best string
+	var bestScore uint64
+	for _, peer := range peers {
+		score := rendezvousScore(peer, addr)
+		if best == "" || score > bestScore {
+			best, bestScore = peer, score
+		}
+	}
+	return best
+}
+
+func rendezvousScore(peer, addr string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(peer))
+	_, _ = h.Write([]byte("/"))
+	_, _ = h.Write([]byte(addr))
+	return h.Sum64()
+}
+
+// RateFor delegates to the wrapped local store, which owns the per-tenant
+// budget enforcement; the KV layer only changes what rate it sees.
+func (s *RateStore) RateFor(tenant string, streamHashNoShard uint64) (int64, bool) {
+	return s.local.RateFor(tenant, streamHashNoShard)
+}
+
+// snapshotCodec (de)serializes a replica's per-stream, per-shard,
+// per-address rate snapshot for storage in the KV store. The per-shard,
+// per-address breakdown is kept (rather than a single rate per stream) so
+// that mergePeers can resolve a stale republish of the same shard/address
+// pair by two peers during a handoff, and so a stream's distinct shards
+// can still be summed rather than maxed once they reach ApplyRates; see
+// mergePeers.
+type snapshotCodec struct{}
+
+func (snapshotCodec) CodecID() string { return "ratestoreSnapshot" }
+
+func (snapshotCodec) Encode(v interface{}) ([]byte, error) {
+	rates, ok := v.(map[uint64]map[uint64]map[string]int64)
+	if !ok {
+		return nil, errors.Errorf("kv/ratestore: unexpected type %T", v)
+	}
+	return json.Marshal(rates)
+}
+
+func (snapshotCodec) Decode(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return map[uint64]map[uint64]map[string]int64{}, nil
+	}
+	var rates map[uint64]map[uint64]map[string]int64
+	if err := json.Unmarshal(b, &rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
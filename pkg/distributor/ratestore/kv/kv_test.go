@@ -0,0 +1,269 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/kv"
+	"github.com/grafana/dskit/kv/consul"
+	"github.com/grafana/dskit/ring"
+	"github.com/stretchr/testify/require"
+)
+
+// sumRates mirrors the non-KV rateStore's reduction: max across the
+// addresses reporting a shard, summed across shards. It lets these fakes'
+// RateFor report what a real *rateStore would, given the same breakdown
+// ApplyRates received.
+func sumRates(byShard map[uint64]map[string]int64) int64 {
+	var sum int64
+	for _, byAddr := range byShard {
+		var max int64
+		for _, rate := range byAddr {
+			if rate > max {
+				max = rate
+			}
+		}
+		sum += max
+	}
+	return sum
+}
+
+type fakeLocalSource struct {
+	instances []ring.InstanceDesc
+	polled    map[string][]ring.InstanceDesc // replicaID -> instances it was asked to poll
+
+	applied map[uint64]map[uint64]map[string]int64
+}
+
+func newFakeLocalSource(instances []ring.InstanceDesc) *fakeLocalSource {
+	return &fakeLocalSource{
+		instances: instances,
+		polled:    map[string][]ring.InstanceDesc{},
+	}
+}
+
+func (f *fakeLocalSource) HealthyInstances() ([]ring.InstanceDesc, error) {
+	return f.instances, nil
+}
+
+// PollInstances returns a fixed rate of 10 for every stream hash equal to
+// the index of the instance polled, as a single-shard stream keyed by the
+// polled instance's address, so tests can tell both which instances a
+// replica was actually asked to poll and which address contributed each
+// rate.
+func (f *fakeLocalSource) PollInstances(_ context.Context, instances []ring.InstanceDesc) map[uint64]map[uint64]map[string]int64 {
+	out := map[uint64]map[uint64]map[string]int64{}
+	for i, inst := range instances {
+		out[uint64(i)] = map[uint64]map[string]int64{0: {inst.Addr: 10}}
+	}
+	return out
+}
+
+func (f *fakeLocalSource) ApplyRates(rates map[uint64]map[uint64]map[string]int64) {
+	f.applied = rates
+}
+
+func (f *fakeLocalSource) RateFor(_ string, streamHashNoShard uint64) (int64, bool) {
+	return sumRates(f.applied[streamHashNoShard]), true
+}
+
+// fixedRateLocalSource reports the same fixed rate, under the same
+// stream and shard hash, for every instance it's asked to poll, keyed by
+// that instance's address. It's used to simulate two peers each owning a
+// different replica (RF>1) of the very same shard of a logical stream.
+type fixedRateLocalSource struct {
+	instances []ring.InstanceDesc
+	hash      uint64
+	rate      int64
+
+	applied map[uint64]map[uint64]map[string]int64
+}
+
+func (f *fixedRateLocalSource) HealthyInstances() ([]ring.InstanceDesc, error) {
+	return f.instances, nil
+}
+
+func (f *fixedRateLocalSource) PollInstances(_ context.Context, instances []ring.InstanceDesc) map[uint64]map[uint64]map[string]int64 {
+	if len(instances) == 0 {
+		return map[uint64]map[uint64]map[string]int64{}
+	}
+	byAddr := make(map[string]int64, len(instances))
+	for _, inst := range instances {
+		byAddr[inst.Addr] = f.rate
+	}
+	return map[uint64]map[uint64]map[string]int64{f.hash: {0: byAddr}}
+}
+
+func (f *fixedRateLocalSource) ApplyRates(rates map[uint64]map[uint64]map[string]int64) {
+	f.applied = rates
+}
+
+func (f *fixedRateLocalSource) RateFor(_ string, streamHashNoShard uint64) (int64, bool) {
+	return sumRates(f.applied[streamHashNoShard]), true
+}
+
+// shardedLocalSource reports a single, fixed-rate shard of a logical
+// stream for every instance it's asked to poll, under the given
+// StreamHash. It's used to simulate a peer owning one distinct shard of a
+// stream that's been split across ingesters.
+type shardedLocalSource struct {
+	instances []ring.InstanceDesc
+	hash      uint64
+	shard     uint64
+	rate      int64
+
+	applied map[uint64]map[uint64]map[string]int64
+}
+
+func (f *shardedLocalSource) HealthyInstances() ([]ring.InstanceDesc, error) {
+	return f.instances, nil
+}
+
+func (f *shardedLocalSource) PollInstances(_ context.Context, instances []ring.InstanceDesc) map[uint64]map[uint64]map[string]int64 {
+	if len(instances) == 0 {
+		return map[uint64]map[uint64]map[string]int64{}
+	}
+	byAddr := make(map[string]int64, len(instances))
+	for _, inst := range instances {
+		byAddr[inst.Addr] = f.rate
+	}
+	return map[uint64]map[uint64]map[string]int64{f.hash: {f.shard: byAddr}}
+}
+
+func (f *shardedLocalSource) ApplyRates(rates map[uint64]map[uint64]map[string]int64) {
+	f.applied = rates
+}
+
+func (f *shardedLocalSource) RateFor(_ string, streamHashNoShard uint64) (int64, bool) {
+	return sumRates(f.applied[streamHashNoShard]), true
+}
+
+// disjointlyOwnedInstances returns two instances that rendezvous hashing
+// assigns to two different peers, so a test can simulate two replicas of
+// one logical stream's shard being owned (and polled) by different peers.
+func disjointlyOwnedInstances(peers []string) (a, b ring.InstanceDesc) {
+	var firstOwner string
+	for i := 0; ; i++ {
+		inst := ring.InstanceDesc{Addr: fmt.Sprintf("ingester%d", i)}
+		o := owner(inst.Addr, peers)
+		if firstOwner == "" {
+			firstOwner, a = o, inst
+			continue
+		}
+		if o != firstOwner {
+			return a, inst
+		}
+	}
+}
+
+// newSharedTestConfig builds a Config whose KV store is an in-memory
+// client shared by every caller that uses it, so independently-constructed
+// RateStores in a test observe each other's published rates the way
+// distributor replicas would through a real KV backend.
+func newSharedTestConfig() Config {
+	client := consul.NewInMemoryClient(snapshotCodec{}, log.NewNopLogger(), nil)
+	return Config{
+		KVStore:      kv.Config{Store: "inmemory", Mock: client},
+		PushInterval: 10 * time.Millisecond,
+	}
+}
+
+func TestRateStore_OwnershipConverges(t *testing.T) {
+	instances := []ring.InstanceDesc{{Addr: "ingester0"}, {Addr: "ingester1"}, {Addr: "ingester2"}}
+	peers := []string{"replica-a", "replica-b"}
+
+	for _, inst := range instances {
+		o := owner(inst.Addr, peers)
+		require.Contains(t, peers, o)
+		// Every peer must agree on who owns this instance.
+		require.Equal(t, o, owner(inst.Addr, peers))
+	}
+}
+
+func TestRateStore_MergesPeerRates(t *testing.T) {
+	cfg := newSharedTestConfig()
+
+	localA := newFakeLocalSource([]ring.InstanceDesc{{Addr: "ingester0"}})
+	storeA, err := NewRateStore(cfg, "replica-a", localA, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	localB := newFakeLocalSource([]ring.InstanceDesc{{Addr: "ingester0"}})
+	storeB, err := NewRateStore(cfg, "replica-b", localB, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, storeA.tick(ctx))
+	require.NoError(t, storeB.tick(ctx))
+	require.NoError(t, storeA.tick(ctx))
+
+	rate, allowed := storeA.RateFor("fake", 0)
+	require.True(t, allowed)
+	require.Equal(t, int64(10), rate)
+}
+
+// TestRateStore_MaxAcrossReplicasAcrossPeers guards against mergePeers (and
+// its callers) summing two peers' contributions to the same shard instead
+// of taking the max: two peers can each own a different replica (RF>1) of
+// the very same shard, and the reduction must match the local backend and
+// direct-poll fallbacks (max across addresses reporting a shard) rather
+// than inflate the rate by roughly RF on every tick that reaches the KV
+// success path.
+func TestRateStore_MaxAcrossReplicasAcrossPeers(t *testing.T) {
+	cfg := newSharedTestConfig()
+	peers := []string{"replica-a", "replica-b"}
+
+	instA, instB := disjointlyOwnedInstances(peers)
+
+	localA := &fixedRateLocalSource{instances: []ring.InstanceDesc{instA, instB}, hash: 0, rate: 25}
+	storeA, err := NewRateStore(cfg, "replica-a", localA, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	localB := &fixedRateLocalSource{instances: []ring.InstanceDesc{instA, instB}, hash: 0, rate: 35}
+	storeB, err := NewRateStore(cfg, "replica-b", localB, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, storeA.tick(ctx))
+	require.NoError(t, storeB.tick(ctx))
+	require.NoError(t, storeA.tick(ctx))
+
+	rate, allowed := storeA.RateFor("fake", 0)
+	require.True(t, allowed)
+	require.Equal(t, int64(35), rate)
+}
+
+// TestRateStore_SumsAcrossShardsAcrossPeers guards the flip side of
+// TestRateStore_MaxAcrossReplicasAcrossPeers: when two peers each own a
+// *different* shard of the same logical stream (rather than a replica of
+// the same shard), their contributions must still be summed once merged,
+// since that's the stream's true combined rate across all of its shards.
+func TestRateStore_SumsAcrossShardsAcrossPeers(t *testing.T) {
+	cfg := newSharedTestConfig()
+	peers := []string{"replica-a", "replica-b"}
+
+	instA, instB := disjointlyOwnedInstances(peers)
+	// Give each peer the instance that it owns, so each one polls its shard.
+	if owner(instA.Addr, peers) != "replica-a" {
+		instA, instB = instB, instA
+	}
+
+	localA := &shardedLocalSource{instances: []ring.InstanceDesc{instA}, hash: 0, shard: 1, rate: 25}
+	storeA, err := NewRateStore(cfg, "replica-a", localA, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	localB := &shardedLocalSource{instances: []ring.InstanceDesc{instB}, hash: 0, shard: 2, rate: 35}
+	storeB, err := NewRateStore(cfg, "replica-b", localB, nil, log.NewNopLogger())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, storeA.tick(ctx))
+	require.NoError(t, storeB.tick(ctx))
+	require.NoError(t, storeA.tick(ctx))
+
+	rate, allowed := storeA.RateFor("fake", 0)
+	require.True(t, allowed)
+	require.Equal(t, int64(60), rate, "distinct shards owned by different peers should be summed, not maxed")
+}
@@ -0,0 +1,289 @@
+package distributor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/ring"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/util/constants"
+)
+
+// streamUpdateBufferSize bounds how many unconsumed updates a single
+// ingester's stream can queue before the oldest is dropped.
+const streamUpdateBufferSize = 256
+
+var streamReconnectBackoff = backoff.Config{
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+}
+
+// streamingPoller maintains one long-lived StreamStreamRates stream per
+// ingester, rather than issuing a fresh GetStreamRates request on every
+// tick, reconnecting with backoff whenever a stream breaks.
+type streamingPoller struct {
+	clientPool poolClientFactory
+	logger     log.Logger
+	retention  time.Duration
+
+	mu       sync.Mutex
+	streams  map[string]*ingesterStream             // addr -> active stream
+	rates    map[uint64]map[uint64]map[string]int64 // streamHashNoShard -> StreamHash (shard) -> addr -> rate
+	lastSeen map[uint64]time.Time                   // streamHashNoShard -> last time it appeared in an update
+
+	dropped *prometheus.CounterVec
+}
+
+type ingesterStream struct {
+	cancel  context.CancelFunc
+	updates chan *logproto.StreamRatesUpdate
+}
+
+var (
+	streamingMetricsOnce sync.Once
+	streamingDropped     *prometheus.CounterVec
+)
+
+func streamingPollerMetrics(r prometheus.Registerer) *prometheus.CounterVec {
+	streamingMetricsOnce.Do(func() {
+		streamingDropped = promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: constants.Loki,
+			Name:      "distributor_ratestore_stream_updates_dropped_total",
+			Help:      "The number of stream-rate updates dropped because an ingester's update channel was full.",
+		}, []string{"ingester"})
+	})
+	return streamingDropped
+}
+
+func newStreamingPoller(clientPool poolClientFactory, logger log.Logger, retention time.Duration, reg prometheus.Registerer) *streamingPoller {
+	return &streamingPoller{
+		clientPool: clientPool,
+		logger:     logger,
+		retention:  retention,
+		streams:    map[string]*ingesterStream{},
+		rates:      map[uint64]map[uint64]map[string]int64{},
+		lastSeen:   map[uint64]time.Time{},
+		dropped:    streamingPollerMetrics(reg),
+	}
+}
+
+// ensureStreams starts a long-lived stream for every instance that doesn't
+// already have one, and tears down streams for instances no longer in the
+// ring.
+func (p *streamingPoller) ensureStreams(instances []ring.InstanceDesc) {
+	seen := make(map[string]struct{}, len(instances))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, inst := range instances {
+		seen[inst.Addr] = struct{}{}
+		if _, ok := p.streams[inst.Addr]; ok {
+			continue
+		}
+		p.startLocked(inst.Addr)
+	}
+
+	for addr, stream := range p.streams {
+		if _, ok := seen[addr]; !ok {
+			stream.cancel()
+			delete(p.streams, addr)
+			p.forgetAddrLocked(addr)
+		}
+	}
+
+	p.evictStaleLocked()
+}
+
+// evictStaleLocked drops a stream's rate entry once it hasn't appeared in
+// an update for p.retention, mirroring the bucket and window eviction the
+// other RateStore backends do. Callers must hold mu.
+func (p *streamingPoller) evictStaleLocked() {
+	if p.retention <= 0 {
+		return
+	}
+	now := time.Now()
+	for hash, seenAt := range p.lastSeen {
+		if now.Sub(seenAt) > p.retention {
+			delete(p.rates, hash)
+			delete(p.lastSeen, hash)
+		}
+	}
+}
+
+func (p *streamingPoller) startLocked(addr string) {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	updates := make(chan *logproto.StreamRatesUpdate, streamUpdateBufferSize)
+	p.streams[addr] = &ingesterStream{cancel: cancel, updates: updates}
+
+	go p.run(streamCtx, addr, updates)
+	go p.consume(addr, updates)
+}
+
+func (p *streamingPoller) run(ctx context.Context, addr string, updates chan<- *logproto.StreamRatesUpdate) {
+	defer close(updates)
+
+	boff := backoff.New(ctx, streamReconnectBackoff)
+	for boff.Ongoing() {
+		err := p.runOnce(ctx, addr, updates)
+		if ctx.Err() != nil {
+			return
+		}
+		level.Warn(p.logger).Log("msg", "stream-rates stream to ingester failed, reconnecting", "ingester", addr, "err", err)
+		boff.Wait()
+	}
+}
+
+func (p *streamingPoller) runOnce(ctx context.Context, addr string, updates chan<- *logproto.StreamRatesUpdate) error {
+	client, err := p.clientPool.GetClientFor(addr)
+	if err != nil {
+		return err
+	}
+
+	streamClient, ok := client.(logproto.StreamingStreamDataClient)
+	if !ok {
+		return errors.Errorf("client for %s does not support streaming stream rates", addr)
+	}
+
+	stream, err := streamClient.StreamStreamRates(ctx, &logproto.StreamRatesRequest{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		p.enqueue(addr, updates, update)
+	}
+}
+
+// enqueue pushes update onto updates, dropping the oldest queued update
+// (and counting it) rather than blocking the stream's receive loop when
+// the consumer has fallen behind.
+func (p *streamingPoller) enqueue(addr string, updates chan *logproto.StreamRatesUpdate, update *logproto.StreamRatesUpdate) {
+	select {
+	case updates <- update:
+		return
+	default:
+	}
+
+	select {
+	case <-updates:
+		p.dropped.WithLabelValues(addr).Inc()
+	default:
+	}
+
+	select {
+	case updates <- update:
+	default:
+	}
+}
+
+func (p *streamingPoller) consume(addr string, updates <-chan *logproto.StreamRatesUpdate) {
+	for update := range updates {
+		p.apply(addr, update)
+	}
+}
+
+func (p *streamingPoller) apply(addr string, update *logproto.StreamRatesUpdate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if update.Snapshot {
+		p.forgetAddrLocked(addr)
+	}
+
+	// Expired is processed before Updated: a shrunk stream is reported by
+	// expiring it in full and re-sending every shard it still has, so
+	// clearing addr's old entries first lets the Updated loop below rebuild
+	// exactly the surviving shard set instead of wiping it back out.
+	for _, hash := range update.Expired {
+		p.forgetStreamLocked(hash, addr)
+	}
+
+	now := time.Now()
+	for _, rate := range update.Updated {
+		if _, ok := p.rates[rate.StreamHashNoShard]; !ok {
+			p.rates[rate.StreamHashNoShard] = map[uint64]map[string]int64{}
+		}
+		if _, ok := p.rates[rate.StreamHashNoShard][rate.StreamHash]; !ok {
+			p.rates[rate.StreamHashNoShard][rate.StreamHash] = map[string]int64{}
+		}
+		p.rates[rate.StreamHashNoShard][rate.StreamHash][addr] = rate.Rate
+		p.lastSeen[rate.StreamHashNoShard] = now
+	}
+}
+
+// forgetAddrLocked removes addr's contribution to every shard of every
+// stream it's currently reported against, reclaiming a stream (and its
+// lastSeen entry) once no shard has any address left reporting it. Callers
+// must hold mu.
+func (p *streamingPoller) forgetAddrLocked(addr string) {
+	for hash := range p.rates {
+		p.forgetStreamLocked(hash, addr)
+	}
+}
+
+// forgetStreamLocked removes addr's contribution to hash (across all of its
+// shards), reclaiming hash once no shard has any address left reporting it.
+// Callers must hold mu.
+func (p *streamingPoller) forgetStreamLocked(hash uint64, addr string) {
+	byShard, ok := p.rates[hash]
+	if !ok {
+		return
+	}
+
+	empty := true
+	for shard, byAddr := range byShard {
+		delete(byAddr, addr)
+		if len(byAddr) == 0 {
+			delete(byShard, shard)
+		} else {
+			empty = false
+		}
+	}
+
+	if empty {
+		delete(p.rates, hash)
+		delete(p.lastSeen, hash)
+	}
+}
+
+// Snapshot returns a copy of the current per-stream, per-shard,
+// per-ingester rates accumulated from all active streams.
+func (p *streamingPoller) Snapshot() map[uint64]map[uint64]map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make(map[uint64]map[uint64]map[string]int64, len(p.rates))
+	for hash, byShard := range p.rates {
+		cpShard := make(map[uint64]map[string]int64, len(byShard))
+		for shard, byAddr := range byShard {
+			cpAddr := make(map[string]int64, len(byAddr))
+			for a, rate := range byAddr {
+				cpAddr[a] = rate
+			}
+			cpShard[shard] = cpAddr
+		}
+		out[hash] = cpShard
+	}
+	return out
+}
+
+func (p *streamingPoller) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.streams {
+		s.cancel()
+	}
+}
@@ -0,0 +1,151 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+func newTestStreamingPoller() *streamingPoller {
+	return &streamingPoller{
+		clientPool: newFakeClientPool(),
+		logger:     log.NewNopLogger(),
+		streams:    map[string]*ingesterStream{},
+		rates:      map[uint64]map[uint64]map[string]int64{},
+		lastSeen:   map[uint64]time.Time{},
+		dropped:    streamingPollerMetrics(prometheus.NewRegistry()),
+	}
+}
+
+func TestStreamingPoller_Apply(t *testing.T) {
+	t.Run("a snapshot replaces the ingester's previously known streams", func(t *testing.T) {
+		p := newTestStreamingPoller()
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated: []*logproto.StreamRate{
+				{StreamHashNoShard: 0, Rate: 10},
+				{StreamHashNoShard: 1, Rate: 20},
+			},
+		})
+		require.Equal(t, map[uint64]map[uint64]map[string]int64{
+			0: {0: {"ingester0": 10}},
+			1: {0: {"ingester0": 20}},
+		}, p.Snapshot())
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated: []*logproto.StreamRate{
+				{StreamHashNoShard: 0, Rate: 15},
+			},
+		})
+		require.Equal(t, map[uint64]map[uint64]map[string]int64{
+			0: {0: {"ingester0": 15}},
+		}, p.Snapshot())
+		require.NotContains(t, p.lastSeen, uint64(1), "a stream whose byAddr map emptied out should have its lastSeen entry reclaimed too")
+	})
+
+	t.Run("a delta only updates and expires the streams it names", func(t *testing.T) {
+		p := newTestStreamingPoller()
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated: []*logproto.StreamRate{
+				{StreamHashNoShard: 0, Rate: 10},
+				{StreamHashNoShard: 1, Rate: 20},
+			},
+		})
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Updated: []*logproto.StreamRate{{StreamHashNoShard: 1, Rate: 25}},
+			Expired: []uint64{0},
+		})
+
+		require.Equal(t, map[uint64]map[uint64]map[string]int64{
+			1: {0: {"ingester0": 25}},
+		}, p.Snapshot())
+	})
+
+	t.Run("a resync update (expired and updated for the same hash together) replaces rather than wipes the shard set", func(t *testing.T) {
+		p := newTestStreamingPoller()
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated: []*logproto.StreamRate{
+				{StreamHash: 1, StreamHashNoShard: 0, Rate: 10},
+				{StreamHash: 2, StreamHashNoShard: 0, Rate: 20},
+			},
+		})
+
+		// Shard 2 stopped being reported; shard 1 survives and is re-sent
+		// alongside the resync, the way diffStreamRates produces it.
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Updated: []*logproto.StreamRate{{StreamHash: 1, StreamHashNoShard: 0, Rate: 10}},
+			Expired: []uint64{0},
+		})
+
+		require.Equal(t, map[uint64]map[uint64]map[string]int64{
+			0: {1: {"ingester0": 10}},
+		}, p.Snapshot(), "shard 1 must survive the resync even though its base hash was also reported expired")
+	})
+
+	t.Run("distinct shards of the same stream reported by different ingesters are kept separate", func(t *testing.T) {
+		p := newTestStreamingPoller()
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated:  []*logproto.StreamRate{{StreamHash: 1, StreamHashNoShard: 0, Rate: 10}},
+		})
+		p.apply("ingester1", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated:  []*logproto.StreamRate{{StreamHash: 2, StreamHashNoShard: 0, Rate: 20}},
+		})
+
+		require.Equal(t, map[uint64]map[uint64]map[string]int64{
+			0: {
+				1: {"ingester0": 10},
+				2: {"ingester1": 20},
+			},
+		}, p.Snapshot())
+	})
+
+	t.Run("a stream unseen past retention is reclaimed", func(t *testing.T) {
+		p := newTestStreamingPoller()
+		p.retention = time.Millisecond
+
+		p.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated:  []*logproto.StreamRate{{StreamHashNoShard: 0, Rate: 10}},
+		})
+
+		p.mu.Lock()
+		p.lastSeen[0] = time.Now().Add(-time.Hour)
+		p.evictStaleLocked()
+		p.mu.Unlock()
+
+		require.Empty(t, p.Snapshot())
+	})
+}
+
+func TestStreamingPoller_EnqueueDropsOldest(t *testing.T) {
+	p := newTestStreamingPoller()
+	updates := make(chan *logproto.StreamRatesUpdate, 1)
+
+	first := &logproto.StreamRatesUpdate{Updated: []*logproto.StreamRate{{StreamHashNoShard: 0, Rate: 1}}}
+	second := &logproto.StreamRatesUpdate{Updated: []*logproto.StreamRate{{StreamHashNoShard: 0, Rate: 2}}}
+
+	p.enqueue("ingester0", updates, first)
+	p.enqueue("ingester0", updates, second)
+
+	require.Len(t, updates, 1)
+	require.Same(t, second, <-updates)
+
+	counter := p.dropped.WithLabelValues("ingester0")
+	require.Equal(t, float64(1), testutil.ToFloat64(counter))
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/grafana/loki/pkg/distributor/shardstreams"
 	"github.com/grafana/loki/pkg/validation"
 
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 
 	client2 "github.com/grafana/loki/pkg/ingester/client"
@@ -18,6 +20,8 @@ import (
 
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/ring/client"
+
+	ratestorekv "github.com/grafana/loki/pkg/distributor/ratestore/kv"
 )
 
 func TestRateStore(t *testing.T) {
@@ -47,13 +51,14 @@ func TestRateStore(t *testing.T) {
 		defer tc.rateStore.StopAsync()
 
 		require.Eventually(t, func() bool { // There will be data
-			return tc.rateStore.RateFor(0) != 0
+			rate, _ := tc.rateStore.RateFor(fakeTenant, 0)
+			return rate != 0
 		}, time.Second, time.Millisecond)
 
-		require.Equal(t, int64(15), tc.rateStore.RateFor(0))
-		require.Equal(t, int64(25), tc.rateStore.RateFor(1))
-		require.Equal(t, int64(35), tc.rateStore.RateFor(2))
-		require.Equal(t, int64(45), tc.rateStore.RateFor(3))
+		assertRate(t, tc.rateStore, 15, 0)
+		assertRate(t, tc.rateStore, 25, 1)
+		assertRate(t, tc.rateStore, 35, 2)
+		assertRate(t, tc.rateStore, 45, 3)
 	})
 
 	t.Run("it reports the highest rate from replicas", func(t *testing.T) {
@@ -79,10 +84,11 @@ func TestRateStore(t *testing.T) {
 		defer tc.rateStore.StopAsync()
 
 		require.Eventually(t, func() bool { // There will be data
-			return tc.rateStore.RateFor(0) != 0
+			rate, _ := tc.rateStore.RateFor(fakeTenant, 0)
+			return rate != 0
 		}, time.Second, time.Millisecond)
 
-		require.Equal(t, int64(35), tc.rateStore.RateFor(0))
+		assertRate(t, tc.rateStore, 35, 0)
 	})
 
 	t.Run("it aggregates rates over shards", func(t *testing.T) {
@@ -104,10 +110,37 @@ func TestRateStore(t *testing.T) {
 		defer tc.rateStore.StopAsync()
 
 		require.Eventually(t, func() bool { // There will be data
-			return tc.rateStore.RateFor(0) != 0
+			rate, _ := tc.rateStore.RateFor(fakeTenant, 0)
+			return rate != 0
+		}, time.Second, time.Millisecond)
+
+		assertRate(t, tc.rateStore, 75, 0)
+	})
+
+	t.Run("it sums distinct shards even when they're spread across different ingesters", func(t *testing.T) {
+		tc := setup(true)
+		tc.ring.replicationSet = ring.ReplicationSet{
+			Instances: []ring.InstanceDesc{
+				{Addr: "ingester0"},
+				{Addr: "ingester1"},
+			},
+		}
+
+		tc.clientPool.clients = map[string]client.PoolClient{
+			"ingester0": newRateClient([]*logproto.StreamRate{{
+				StreamHash: 1, StreamHashNoShard: 0, Rate: 25}}),
+			"ingester1": newRateClient([]*logproto.StreamRate{{
+				StreamHash: 2, StreamHashNoShard: 0, Rate: 35}}),
+		}
+		_ = tc.rateStore.StartAsync(context.Background())
+		defer tc.rateStore.StopAsync()
+
+		require.Eventually(t, func() bool { // There will be data
+			rate, _ := tc.rateStore.RateFor(fakeTenant, 0)
+			return rate != 0
 		}, time.Second, time.Millisecond)
 
-		require.Equal(t, int64(75), tc.rateStore.RateFor(0))
+		assertRate(t, tc.rateStore, 60, 0, "two distinct shards on different ingesters should be summed, not maxed")
 	})
 
 	t.Run("it does nothing if no one has enabled sharding", func(t *testing.T) {
@@ -127,10 +160,181 @@ func TestRateStore(t *testing.T) {
 		defer tc.rateStore.StopAsync()
 
 		time.Sleep(time.Second)
-		require.Equal(t, int64(0), tc.rateStore.RateFor(0))
+		assertRate(t, tc.rateStore, 0, 0)
+	})
+
+	t.Run("it rejects a stream once it exceeds its per-stream budget", func(t *testing.T) {
+		tc := setupWithOverrides(&fakeOverrides{
+			limits: map[string]*validation.Limits{
+				fakeTenant: {
+					ShardStreams:            &shardstreams.Config{Enabled: true},
+					PerStreamRateLimit:      10,
+					PerStreamRateLimitBurst: 10,
+				},
+			},
+		})
+		tc.ring.replicationSet = ring.ReplicationSet{
+			Instances: []ring.InstanceDesc{{Addr: "ingester0"}},
+		}
+		tc.clientPool.clients = map[string]client.PoolClient{
+			"ingester0": newRateClient([]*logproto.StreamRate{{
+				StreamHash: 0, StreamHashNoShard: 0, Rate: 100}}),
+		}
+
+		_ = tc.rateStore.StartAsync(context.Background())
+		defer tc.rateStore.StopAsync()
+
+		require.Eventually(t, func() bool {
+			_, allowed := tc.rateStore.RateFor(fakeTenant, 0)
+			return !allowed
+		}, time.Second, time.Millisecond)
+
+		_, err := CheckRate(tc.rateStore, fakeTenant, 0)
+		require.ErrorIs(t, err, ErrStreamRateLimited)
+	})
+
+	t.Run("it still enforces a per-stream budget when no tenant has sharding enabled", func(t *testing.T) {
+		tc := setupWithOverrides(&fakeOverrides{
+			limits: map[string]*validation.Limits{
+				fakeTenant: {
+					PerStreamRateLimit:      10,
+					PerStreamRateLimitBurst: 10,
+				},
+			},
+		})
+		tc.ring.replicationSet = ring.ReplicationSet{
+			Instances: []ring.InstanceDesc{{Addr: "ingester0"}},
+		}
+		tc.clientPool.clients = map[string]client.PoolClient{
+			"ingester0": newRateClient([]*logproto.StreamRate{{
+				StreamHash: 0, StreamHashNoShard: 0, Rate: 100}}),
+		}
+
+		_ = tc.rateStore.StartAsync(context.Background())
+		defer tc.rateStore.StopAsync()
+
+		require.Eventually(t, func() bool {
+			_, allowed := tc.rateStore.RateFor(fakeTenant, 0)
+			return !allowed
+		}, time.Second, time.Millisecond, "updateAllRates should poll and debit buckets even though sharding is off everywhere")
+
+		_, err := CheckRate(tc.rateStore, fakeTenant, 0)
+		require.ErrorIs(t, err, ErrStreamRateLimited)
+	})
+
+	t.Run("it carries forward a costly ingester's last rate and eventually re-probes it", func(t *testing.T) {
+		tc := setup(true)
+
+		for i := 0; i < costSampleWindow; i++ {
+			tc.rateStore.costs.observe("ingester1", 5*time.Millisecond, 100)
+			tc.rateStore.costs.observe("ingester2", 5*time.Millisecond, 100)
+		}
+		tc.rateStore.costs.observe("ingester0", 500*time.Millisecond, 100)
+
+		tc.rateStore.rateLock.Lock()
+		tc.rateStore.rates = map[uint64]map[uint64]map[string]int64{0: {0: {"ingester0": 42}}}
+		tc.rateStore.rateLock.Unlock()
+
+		client := &countingRateClient{resp: &logproto.StreamRatesResponse{StreamRates: []*logproto.StreamRate{
+			{StreamHash: 0, StreamHashNoShard: 0, Rate: 99},
+		}}}
+		tc.clientPool.clients["ingester0"] = client2.ClosableHealthAndIngesterClient{StreamDataClient: client}
+
+		instances := []ring.InstanceDesc{{Addr: "ingester0"}}
+
+		for i := 0; i < costTrackerMaxConsecutiveSkips; i++ {
+			rates := tc.rateStore.instanceRates(context.Background(), instances)
+			require.Equal(t, int64(42), rates[0][0]["ingester0"], "a skipped ingester's last known rate should be carried forward")
+		}
+		require.Zero(t, client.calls, "a skipped ingester should never actually be polled")
+
+		rates := tc.rateStore.instanceRates(context.Background(), instances)
+		require.Equal(t, int64(99), rates[0][0]["ingester0"], "after its skip streak is exhausted the ingester should be re-probed")
+		require.Equal(t, 1, client.calls)
+	})
+
+	t.Run("it reads from the streaming poller instead of polling directly when streaming is enabled", func(t *testing.T) {
+		tc := setup(true)
+		tc.ring.replicationSet = ring.ReplicationSet{
+			Instances: []ring.InstanceDesc{{Addr: "ingester0"}},
+		}
+		// Deliberately leave the client pool empty: if updateAllRates fell
+		// back to direct polling despite useStreaming, rateForInstance
+		// would fail to find a client and this rate would never appear.
+
+		tc.rateStore.useStreaming = true
+		tc.rateStore.stream = newTestStreamingPoller()
+		tc.rateStore.stream.streams["ingester0"] = &ingesterStream{cancel: func() {}}
+		tc.rateStore.stream.apply("ingester0", &logproto.StreamRatesUpdate{
+			Snapshot: true,
+			Updated:  []*logproto.StreamRate{{StreamHashNoShard: 0, Rate: 55}},
+		})
+
+		require.NoError(t, tc.rateStore.updateAllRates(context.Background()))
+		assertRate(t, tc.rateStore, 55, 0)
+	})
+
+	t.Run("it evicts a stream's rate-limit bucket once RateFor stops asking about it", func(t *testing.T) {
+		tc := setupWithOverrides(&fakeOverrides{
+			limits: map[string]*validation.Limits{
+				fakeTenant: {
+					ShardStreams:            &shardstreams.Config{Enabled: true},
+					PerStreamRateLimit:      10,
+					PerStreamRateLimitBurst: 10,
+				},
+			},
+		})
+		tc.rateStore.bucketRetention = 10 * time.Millisecond
+
+		_, _ = tc.rateStore.RateFor(fakeTenant, 0)
+		tc.rateStore.bucketLock.Lock()
+		_, ok := tc.rateStore.streamBuckets[0]
+		tc.rateStore.bucketLock.Unlock()
+		require.True(t, ok, "RateFor should have created a bucket for the stream")
+
+		time.Sleep(20 * time.Millisecond)
+
+		_ = tc.rateStore.StartAsync(context.Background())
+		defer tc.rateStore.StopAsync()
+
+		require.Eventually(t, func() bool {
+			tc.rateStore.bucketLock.Lock()
+			defer tc.rateStore.bucketLock.Unlock()
+			_, ok := tc.rateStore.streamBuckets[0]
+			return !ok
+		}, time.Second, time.Millisecond, "bucket should have been evicted after going unused past bucketRetention")
+	})
+}
+
+func TestNewConfiguredRateStore(t *testing.T) {
+	t.Run("defaults to polling ingesters directly", func(t *testing.T) {
+		cfg := RateStoreConfig{MaxParallelism: 5, IngesterReqTimeout: time.Second, StreamRateUpdateInterval: 10 * time.Millisecond}
+
+		rs, err := NewConfiguredRateStore(cfg, "replica-a", newFakeRing(), newFakeClientPool(), &fakeOverrides{enabled: true}, prometheus.NewRegistry(), log.NewNopLogger())
+		require.NoError(t, err)
+
+		_, ok := rs.(*rateStore)
+		require.True(t, ok, "the local backend should be the *rateStore itself")
+	})
+
+	t.Run("wraps the local store in a KV-backed RateStore for the kv backend", func(t *testing.T) {
+		cfg := RateStoreConfig{MaxParallelism: 5, IngesterReqTimeout: time.Second, StreamRateUpdateInterval: 10 * time.Millisecond, Backend: RateStoreBackendKV}
+		cfg.KVStore.KVStore.Store = "inmemory"
+
+		rs, err := NewConfiguredRateStore(cfg, "replica-a", newFakeRing(), newFakeClientPool(), &fakeOverrides{enabled: true}, prometheus.NewRegistry(), log.NewNopLogger())
+		require.NoError(t, err)
+
+		_, ok := rs.(*ratestorekv.RateStore)
+		require.True(t, ok, "the kv backend should wrap the local store in a *ratestorekv.RateStore")
 	})
 }
 
+func assertRate(t *testing.T, rs *rateStore, want int64, streamHashNoShard uint64, msgAndArgs ...interface{}) {
+	t.Helper()
+	rate, _ := rs.RateFor(fakeTenant, streamHashNoShard)
+	require.Equal(t, want, rate, msgAndArgs...)
+}
+
 func newFakeRing() *fakeRing {
 	return &fakeRing{}
 }
@@ -176,13 +380,31 @@ func (c *fakeStreamDataClient) GetStreamRates(ctx context.Context, in *logproto.
 	return c.resp, c.err
 }
 
+// countingRateClient counts how many times it's actually been asked for
+// stream rates, so a test can assert a skipped ingester was never polled.
+type countingRateClient struct {
+	resp  *logproto.StreamRatesResponse
+	calls int
+}
+
+func (c *countingRateClient) GetStreamRates(ctx context.Context, in *logproto.StreamRatesRequest, opts ...grpc.CallOption) (*logproto.StreamRatesResponse, error) {
+	c.calls++
+	return c.resp, nil
+}
+
+const fakeTenant = "fake"
+
 type fakeOverrides struct {
 	enabled bool
+	limits  map[string]*validation.Limits
 }
 
 func (c *fakeOverrides) AllByUserID() map[string]*validation.Limits {
+	if c.limits != nil {
+		return c.limits
+	}
 	return map[string]*validation.Limits{
-		"ingester0": {
+		fakeTenant: {
 			ShardStreams: &shardstreams.Config{
 				Enabled: c.enabled,
 			},
@@ -197,6 +419,10 @@ type testContext struct {
 }
 
 func setup(enabled bool) *testContext {
+	return setupWithOverrides(&fakeOverrides{enabled: enabled})
+}
+
+func setupWithOverrides(overrides *fakeOverrides) *testContext {
 	ring := newFakeRing()
 	cp := newFakeClientPool()
 	cfg := RateStoreConfig{MaxParallelism: 5, IngesterReqTimeout: time.Second, StreamRateUpdateInterval: 10 * time.Millisecond}
@@ -204,6 +430,6 @@ func setup(enabled bool) *testContext {
 	return &testContext{
 		ring:       ring,
 		clientPool: cp,
-		rateStore:  NewRateStore(cfg, ring, cp, &fakeOverrides{enabled}, nil),
+		rateStore:  NewRateStore(cfg, ring, cp, overrides, prometheus.NewRegistry(), nil),
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,48 @@
+package shardstreams
+
+import (
+	"flag"
+	"math"
+)
+
+// Config for the shard streams feature.
+type Config struct {
+	Enabled        bool `yaml:"enabled"`
+	LoggingEnabled bool `yaml:"logging_enabled"`
+
+	// DesiredRate is the threshold, in bytes/sec, that a stream is allowed to
+	// reach before being split onto additional shards.
+	DesiredRate int64 `yaml:"desired_rate"`
+}
+
+// RegisterFlagsWithPrefix registers distributor-side sharding flags.
+func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, prefix+"shard-streams.enabled", false, "Automatically shard streams to keep them under the per-stream rate limit.")
+	f.BoolVar(&cfg.LoggingEnabled, prefix+"shard-streams.logging-enabled", false, "Enable logging when sharding streams.")
+	f.Int64Var(&cfg.DesiredRate, prefix+"shard-streams.desired-rate", 3<<20, "If sharding is enabled, the ideal rate, in bytes/sec, a shard should be receiving.")
+}
+
+// Rates is a statistical summary of a stream's rate over a sliding window,
+// as produced by distributor.WindowedRateStore.
+type Rates struct {
+	P50  int64
+	P95  int64
+	Max  int64
+	EWMA int64
+}
+
+// ShardCountFor returns the number of shards a stream should be split into
+// given its windowed rate statistics. It bases the decision on P95 rather
+// than rates.Max or the latest sample, so a brief spike doesn't push the
+// shard count up only to pull it back down again a tick later.
+func ShardCountFor(cfg Config, rates Rates) int {
+	if !cfg.Enabled || cfg.DesiredRate <= 0 || rates.P95 <= 0 {
+		return 1
+	}
+
+	shards := int(math.Ceil(float64(rates.P95) / float64(cfg.DesiredRate)))
+	if shards < 1 {
+		shards = 1
+	}
+	return shards
+}
@@ -0,0 +1,18 @@
+package shardstreams
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardCountFor(t *testing.T) {
+	cfg := Config{Enabled: true, DesiredRate: 1 << 20}
+
+	require.Equal(t, 1, ShardCountFor(Config{Enabled: false}, Rates{P95: 10 << 20}), "sharding must be disabled when the feature is off")
+	require.Equal(t, 1, ShardCountFor(cfg, Rates{}), "a stream with no observed rate yet needs no sharding")
+	require.Equal(t, 1, ShardCountFor(cfg, Rates{P95: 1 << 19}))
+	require.Equal(t, 3, ShardCountFor(cfg, Rates{P95: 2<<20 + 1}))
+
+	require.Equal(t, 1, ShardCountFor(cfg, Rates{P95: 1 << 19, Max: 50 << 20}), "the decision is based on P95, not a transient spike captured in Max")
+}
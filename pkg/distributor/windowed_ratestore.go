@@ -0,0 +1,183 @@
+package distributor
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/services"
+
+	"github.com/grafana/loki/pkg/distributor/shardstreams"
+)
+
+// windowedEWMAAlpha weights how quickly a stream's EWMA reacts to a new
+// sample; smaller values smooth out spikes more aggressively.
+const windowedEWMAAlpha = 0.2
+
+// rateSource supplies the instantaneous per-stream rate a WindowedRateStore
+// samples on every tick. *rateStore satisfies this.
+type rateSource interface {
+	RatesSnapshot() map[uint64]int64
+}
+
+// WindowedRateStore samples a rateSource on a fixed interval and keeps a
+// per-stream sliding window of the last K samples, so callers that need a
+// stable view of a stream's rate (rather than whatever the last poll
+// happened to report) can base decisions on a percentile instead of an
+// instantaneous value. It's used by the distributor's shard-stream logic to
+// decide shard counts from P95 rather than the latest sample, avoiding
+// oscillation across a brief spike.
+type WindowedRateStore struct {
+	services.Service
+
+	source    rateSource
+	k         int
+	retention time.Duration
+
+	mu      sync.Mutex
+	windows map[uint64]*streamWindow
+}
+
+// NewWindowedRateStore builds a WindowedRateStore that samples source every
+// cfg.StreamRateUpdateInterval. The number of samples kept per stream (K) is
+// derived from cfg.RateWindow / cfg.StreamRateUpdateInterval.
+func NewWindowedRateStore(cfg RateStoreConfig, source rateSource) *WindowedRateStore {
+	s := &WindowedRateStore{
+		source:    source,
+		k:         windowSamples(cfg),
+		retention: cfg.StreamRateRetentionPeriod,
+		windows:   map[uint64]*streamWindow{},
+	}
+	s.Service = services.NewTimerService(cfg.StreamRateUpdateInterval, nil, s.sample, nil)
+	return s
+}
+
+func windowSamples(cfg RateStoreConfig) int {
+	if cfg.StreamRateUpdateInterval <= 0 {
+		return 1
+	}
+	k := int(cfg.RateWindow / cfg.StreamRateUpdateInterval)
+	if k < 1 {
+		k = 1
+	}
+	return k
+}
+
+func (s *WindowedRateStore) sample(_ context.Context) error {
+	now := time.Now()
+	rates := s.source.RatesSnapshot()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, rate := range rates {
+		w, ok := s.windows[hash]
+		if !ok {
+			w = newStreamWindow(s.k)
+			s.windows[hash] = w
+		}
+		w.add(rate, now)
+	}
+
+	if s.retention <= 0 {
+		return nil
+	}
+	for hash, w := range s.windows {
+		if now.Sub(w.lastSeen) > s.retention {
+			delete(s.windows, hash)
+		}
+	}
+	return nil
+}
+
+// RateFor returns the windowed rate statistics for a stream. A stream that
+// hasn't been sampled yet reports a zero value.
+func (s *WindowedRateStore) RateFor(streamHashNoShard uint64) shardstreams.Rates {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.windows[streamHashNoShard]
+	if !ok {
+		return shardstreams.Rates{}
+	}
+	return w.summary()
+}
+
+// ShardCountFor returns the number of shards a stream should be split into,
+// based on its windowed P95 rather than its latest instantaneous sample.
+// This is the one intended call site for shardstreams.ShardCountFor: write
+// path code that needs a shard count for streamHashNoShard should go
+// through here instead of calling shardstreams.ShardCountFor directly
+// against an instantaneous rate.
+func (s *WindowedRateStore) ShardCountFor(cfg shardstreams.Config, streamHashNoShard uint64) int {
+	return shardstreams.ShardCountFor(cfg, s.RateFor(streamHashNoShard))
+}
+
+// streamWindow is a fixed-size circular buffer of a stream's last K rate
+// samples, plus an EWMA carried alongside it.
+type streamWindow struct {
+	buf      []int64
+	next     int
+	count    int
+	ewma     float64
+	lastSeen time.Time
+}
+
+func newStreamWindow(k int) *streamWindow {
+	if k < 1 {
+		k = 1
+	}
+	return &streamWindow{buf: make([]int64, k)}
+}
+
+func (w *streamWindow) add(rate int64, at time.Time) {
+	w.buf[w.next] = rate
+	w.next = (w.next + 1) % len(w.buf)
+	if w.count < len(w.buf) {
+		w.count++
+	}
+
+	if w.lastSeen.IsZero() {
+		w.ewma = float64(rate)
+	} else {
+		w.ewma = windowedEWMAAlpha*float64(rate) + (1-windowedEWMAAlpha)*w.ewma
+	}
+	w.lastSeen = at
+}
+
+func (w *streamWindow) summary() shardstreams.Rates {
+	samples := make([]int64, w.count)
+	copy(samples, w.buf[:w.count])
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var max int64
+	for _, rate := range samples {
+		if rate > max {
+			max = rate
+		}
+	}
+
+	return shardstreams.Rates{
+		P50:  percentile(samples, 0.5),
+		P95:  percentile(samples, 0.95),
+		Max:  max,
+		EWMA: int64(w.ewma),
+	}
+}
+
+// percentile returns the value at percentile p (0..1) of sorted, using the
+// nearest-rank method.
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,91 @@
+package distributor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/distributor/shardstreams"
+)
+
+type fakeRateSource struct {
+	rates map[uint64]int64
+}
+
+func (f *fakeRateSource) RatesSnapshot() map[uint64]int64 {
+	return f.rates
+}
+
+func TestWindowedRateStore(t *testing.T) {
+	t.Run("P95 is stable across a spike-then-decay pattern", func(t *testing.T) {
+		source := &fakeRateSource{rates: map[uint64]int64{0: 100}}
+		s := NewWindowedRateStore(RateStoreConfig{
+			StreamRateUpdateInterval: time.Second,
+			RateWindow:               20 * time.Second,
+		}, source)
+
+		for i := 0; i < 20; i++ {
+			require.NoError(t, s.sample(context.Background()))
+		}
+		require.Equal(t, shardstreams.Rates{P50: 100, P95: 100, Max: 100, EWMA: 100}, s.RateFor(0))
+
+		source.rates[0] = 10000
+		require.NoError(t, s.sample(context.Background()))
+		spiked := s.RateFor(0)
+		require.Equal(t, int64(10000), spiked.Max, "Max should reflect the spike immediately")
+		require.Equal(t, int64(100), spiked.P95, "a single sample out of a full window shouldn't move P95")
+
+		source.rates[0] = 100
+		for i := 0; i < 20; i++ {
+			require.NoError(t, s.sample(context.Background()))
+		}
+		decayed := s.RateFor(0)
+		require.Equal(t, int64(100), decayed.P95)
+		require.Equal(t, int64(100), decayed.Max, "Max should have decayed once the spike has aged out of the window")
+	})
+
+	t.Run("a stream unseen for longer than the retention period is evicted", func(t *testing.T) {
+		source := &fakeRateSource{rates: map[uint64]int64{0: 100}}
+		s := NewWindowedRateStore(RateStoreConfig{
+			StreamRateUpdateInterval:  time.Second,
+			RateWindow:                10 * time.Second,
+			StreamRateRetentionPeriod: time.Millisecond,
+		}, source)
+
+		require.NoError(t, s.sample(context.Background()))
+		require.NotZero(t, s.RateFor(0))
+
+		time.Sleep(2 * time.Millisecond)
+		source.rates = map[uint64]int64{}
+		require.NoError(t, s.sample(context.Background()))
+
+		require.Zero(t, s.RateFor(0))
+	})
+
+	t.Run("ShardCountFor bases the decision on P95, not a mid-window spike", func(t *testing.T) {
+		source := &fakeRateSource{rates: map[uint64]int64{0: 100}}
+		s := NewWindowedRateStore(RateStoreConfig{
+			StreamRateUpdateInterval: time.Second,
+			RateWindow:               20 * time.Second,
+		}, source)
+
+		for i := 0; i < 20; i++ {
+			require.NoError(t, s.sample(context.Background()))
+		}
+
+		cfg := shardstreams.Config{Enabled: true, DesiredRate: 100}
+		require.Equal(t, 1, s.ShardCountFor(cfg, 0))
+
+		source.rates[0] = 1000
+		require.NoError(t, s.sample(context.Background()))
+		require.Equal(t, 1, s.ShardCountFor(cfg, 0), "a single spiking sample shouldn't move the shard count")
+	})
+}
+
+func TestPercentile(t *testing.T) {
+	require.Equal(t, int64(0), percentile(nil, 0.95))
+	require.Equal(t, int64(2), percentile([]int64{1, 2, 3, 4}, 0.5))
+	require.Equal(t, int64(4), percentile([]int64{1, 2, 3, 4}, 0.95))
+}
@@ -0,0 +1,142 @@
+package ingester
+
+import (
+	"time"
+
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+// StreamRateSource reports the current rate for every stream an ingester
+// is still tracking. It's satisfied by the same instance lookup the
+// existing unary GetStreamRates handler uses.
+type StreamRateSource interface {
+	StreamRates() []*logproto.StreamRate
+}
+
+// StreamRatesStreamer adds the server-streaming half of
+// logproto.StreamingStreamDataServer to an ingester's existing unary
+// StreamDataServer, so a distributor's long-lived stream gets deltas as
+// streams change instead of having to poll GetStreamRates on every tick.
+type StreamRatesStreamer struct {
+	logproto.StreamDataServer
+
+	source           StreamRateSource
+	pollInterval     time.Duration
+	snapshotInterval time.Duration
+}
+
+// NewStreamRatesStreamer wraps base (an ingester's existing unary
+// StreamDataServer) with a StreamStreamRates implementation that samples
+// source every pollInterval and sends a delta, resending a full snapshot
+// every snapshotInterval so a newly (re)connected client converges without
+// needing to reconnect.
+func NewStreamRatesStreamer(base logproto.StreamDataServer, source StreamRateSource, pollInterval, snapshotInterval time.Duration) *StreamRatesStreamer {
+	return &StreamRatesStreamer{
+		StreamDataServer: base,
+		source:           source,
+		pollInterval:     pollInterval,
+		snapshotInterval: snapshotInterval,
+	}
+}
+
+// StreamStreamRates implements logproto.StreamingStreamDataServer. It runs
+// until the client disconnects or the stream fails to send, polling
+// s.source on s.pollInterval and pushing only the streams that changed
+// since the last message, except every s.snapshotInterval when it instead
+// pushes the full current set.
+func (s *StreamRatesStreamer) StreamStreamRates(_ *logproto.StreamRatesRequest, stream logproto.StreamRatesStreamServer) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	last := map[streamShardKey]*logproto.StreamRate{}
+	var lastSnapshot time.Time
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+			current := byHash(s.source.StreamRates())
+			snapshot := lastSnapshot.IsZero() || time.Since(lastSnapshot) >= s.snapshotInterval
+
+			update := diffStreamRates(last, current, snapshot)
+			if update == nil {
+				continue
+			}
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+			if snapshot {
+				lastSnapshot = time.Now()
+			}
+			last = current
+		}
+	}
+}
+
+// streamShardKey identifies one shard of one logical stream. A single
+// ingester can legitimately report several shards sharing a
+// StreamHashNoShard at once, so that field alone isn't a unique key:
+// byHash and diffStreamRates key on the pair to avoid collapsing distinct
+// shards onto the same entry.
+type streamShardKey struct {
+	hashNoShard uint64
+	hash        uint64
+}
+
+func byHash(rates []*logproto.StreamRate) map[streamShardKey]*logproto.StreamRate {
+	out := make(map[streamShardKey]*logproto.StreamRate, len(rates))
+	for _, r := range rates {
+		out[streamShardKey{hashNoShard: r.StreamHashNoShard, hash: r.StreamHash}] = r
+	}
+	return out
+}
+
+// diffStreamRates computes what should be sent for a tick that observed
+// current, given what was last sent in last: on a snapshot tick, that's
+// every stream in current; otherwise it's only the shards that are new,
+// changed, or need resending because the stream's shard set shrank.
+//
+// Expired carries StreamHashNoShard values, per the wire format, so there's
+// no way to expire a single shard on the wire: a stream whose shard set
+// shrinks (one of its shards stopped being reported, even though others of
+// the same stream remain) is reported expired in full, with every shard it
+// still has re-sent in Updated in the same message, so a receiver that
+// processes Expired before Updated (as streamingPoller.apply does) ends up
+// with exactly the surviving set. Returns nil when there's nothing to send,
+// so a quiet, non-snapshot tick doesn't produce an empty message.
+func diffStreamRates(last, current map[streamShardKey]*logproto.StreamRate, snapshot bool) *logproto.StreamRatesUpdate {
+	resync := shrunkStreams(last, current)
+
+	var updated []*logproto.StreamRate
+	for key, rate := range current {
+		prev, ok := last[key]
+		_, needsResync := resync[key.hashNoShard]
+		if snapshot || needsResync || !ok || prev.Rate != rate.Rate {
+			updated = append(updated, rate)
+		}
+	}
+
+	expired := make([]uint64, 0, len(resync))
+	for hash := range resync {
+		expired = append(expired, hash)
+	}
+
+	if !snapshot && len(updated) == 0 && len(expired) == 0 {
+		return nil
+	}
+	return &logproto.StreamRatesUpdate{Snapshot: snapshot, Updated: updated, Expired: expired}
+}
+
+// shrunkStreams returns the StreamHashNoShard of every stream in last that
+// lost at least one shard by current, whether that's because the whole
+// stream is gone or just some of its shards are.
+func shrunkStreams(last, current map[streamShardKey]*logproto.StreamRate) map[uint64]struct{} {
+	out := map[uint64]struct{}{}
+	for key := range last {
+		if _, ok := current[key]; !ok {
+			out[key.hashNoShard] = struct{}{}
+		}
+	}
+	return out
+}
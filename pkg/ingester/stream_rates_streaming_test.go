@@ -0,0 +1,99 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+func TestByHash(t *testing.T) {
+	t.Run("distinct shards sharing a StreamHashNoShard are kept separate", func(t *testing.T) {
+		rates := []*logproto.StreamRate{
+			{StreamHash: 1, StreamHashNoShard: 0, Rate: 10},
+			{StreamHash: 2, StreamHashNoShard: 0, Rate: 20},
+			{StreamHash: 3, StreamHashNoShard: 0, Rate: 30},
+		}
+
+		out := byHash(rates)
+		require.Len(t, out, 3, "all three shards of the same base stream must survive, not collapse onto one key")
+		require.Equal(t, int64(10), out[streamShardKey{hashNoShard: 0, hash: 1}].Rate)
+		require.Equal(t, int64(20), out[streamShardKey{hashNoShard: 0, hash: 2}].Rate)
+		require.Equal(t, int64(30), out[streamShardKey{hashNoShard: 0, hash: 3}].Rate)
+	})
+}
+
+func TestDiffStreamRates(t *testing.T) {
+	t.Run("a snapshot tick sends every current stream regardless of change", func(t *testing.T) {
+		last := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0}: {StreamHash: 0, StreamHashNoShard: 0, Rate: 10},
+		}
+		current := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0}: {StreamHash: 0, StreamHashNoShard: 0, Rate: 10},
+		}
+
+		update := diffStreamRates(last, current, true)
+		require.True(t, update.Snapshot)
+		require.Equal(t, []*logproto.StreamRate{{StreamHash: 0, StreamHashNoShard: 0, Rate: 10}}, update.Updated)
+		require.Empty(t, update.Expired)
+	})
+
+	t.Run("a delta tick only reports new, changed, and expired streams", func(t *testing.T) {
+		last := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0}: {StreamHashNoShard: 0, Rate: 10},
+			{hashNoShard: 1}: {StreamHashNoShard: 1, Rate: 20},
+		}
+		current := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0}: {StreamHashNoShard: 0, Rate: 15}, // changed
+			{hashNoShard: 2}: {StreamHashNoShard: 2, Rate: 30}, // new
+			// 1 is gone: expired
+		}
+
+		update := diffStreamRates(last, current, false)
+		require.False(t, update.Snapshot)
+		require.ElementsMatch(t, []*logproto.StreamRate{
+			{StreamHashNoShard: 0, Rate: 15},
+			{StreamHashNoShard: 2, Rate: 30},
+		}, update.Updated)
+		require.Equal(t, []uint64{1}, update.Expired)
+	})
+
+	t.Run("a quiet delta tick sends nothing", func(t *testing.T) {
+		last := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0}: {StreamHashNoShard: 0, Rate: 10},
+		}
+		current := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0}: {StreamHashNoShard: 0, Rate: 10},
+		}
+
+		require.Nil(t, diffStreamRates(last, current, false))
+	})
+
+	t.Run("a stream that loses one of several shards is resynced in full", func(t *testing.T) {
+		last := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0, hash: 1}: {StreamHash: 1, StreamHashNoShard: 0, Rate: 10},
+			{hashNoShard: 0, hash: 2}: {StreamHash: 2, StreamHashNoShard: 0, Rate: 20},
+		}
+		current := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0, hash: 1}: {StreamHash: 1, StreamHashNoShard: 0, Rate: 10},
+			// shard 2 dropped out, but shard 1 of the same base stream remains
+		}
+
+		update := diffStreamRates(last, current, false)
+		require.Equal(t, []uint64{0}, update.Expired, "the wire format can't expire a single shard, so the whole stream is resynced")
+		require.Equal(t, []*logproto.StreamRate{{StreamHash: 1, StreamHashNoShard: 0, Rate: 10}}, update.Updated,
+			"every surviving shard must be re-sent so the receiver rebuilds exactly the new shard set after clearing the expired entry")
+	})
+
+	t.Run("a stream is reported expired once every one of its shards is gone", func(t *testing.T) {
+		last := map[streamShardKey]*logproto.StreamRate{
+			{hashNoShard: 0, hash: 1}: {StreamHash: 1, StreamHashNoShard: 0, Rate: 10},
+			{hashNoShard: 0, hash: 2}: {StreamHash: 2, StreamHashNoShard: 0, Rate: 20},
+		}
+		current := map[streamShardKey]*logproto.StreamRate{}
+
+		update := diffStreamRates(last, current, false)
+		require.Equal(t, []uint64{0}, update.Expired)
+	})
+}
@@ -0,0 +1,529 @@
+// Code generated by protoc-gen-gogo and protoc-gen-go-grpc from
+// stream_rates_streaming.proto. DO NOT EDIT.
+
+package logproto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+
+	proto "github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// StreamRatesUpdate is sent by StreamDataStreaming.StreamStreamRates in
+// place of a full StreamRatesResponse on every change. Snapshot is true on
+// the first message of a stream and periodically thereafter; between
+// snapshots, only Updated and Expired carry the streams that changed since
+// the previous message, so a long-lived stream doesn't have to retransmit
+// the full set of known streams on every update.
+type StreamRatesUpdate struct {
+	Snapshot bool          `protobuf:"varint,1,opt,name=snapshot,proto3" json:"snapshot,omitempty"`
+	Updated  []*StreamRate `protobuf:"bytes,2,rep,name=updated,proto3" json:"updated,omitempty"`
+	Expired  []uint64      `protobuf:"varint,3,rep,packed,name=expired,proto3" json:"expired,omitempty"` // StreamHashNoShard values no longer being reported
+}
+
+func (m *StreamRatesUpdate) Reset()         { *m = StreamRatesUpdate{} }
+func (m *StreamRatesUpdate) String() string { return proto.CompactTextString(m) }
+func (*StreamRatesUpdate) ProtoMessage()    {}
+
+func (m *StreamRatesUpdate) GetSnapshot() bool {
+	if m != nil {
+		return m.Snapshot
+	}
+	return false
+}
+
+func (m *StreamRatesUpdate) GetUpdated() []*StreamRate {
+	if m != nil {
+		return m.Updated
+	}
+	return nil
+}
+
+func (m *StreamRatesUpdate) GetExpired() []uint64 {
+	if m != nil {
+		return m.Expired
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*StreamRatesUpdate)(nil), "logproto.StreamRatesUpdate")
+}
+
+func (m *StreamRatesUpdate) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *StreamRatesUpdate) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *StreamRatesUpdate) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+
+	if len(m.Expired) > 0 {
+		dAtA2 := make([]byte, len(m.Expired)*10)
+		var j1 int
+		for _, num := range m.Expired {
+			for num >= 1<<7 {
+				dAtA2[j1] = uint8(num&0x7f | 0x80)
+				num >>= 7
+				j1++
+			}
+			dAtA2[j1] = uint8(num)
+			j1++
+		}
+		i -= j1
+		copy(dAtA[i:], dAtA2[:j1])
+		i = encodeVarintStreamRatesStreaming(dAtA, i, uint64(j1))
+		i--
+		dAtA[i] = 0x1a
+	}
+	if len(m.Updated) > 0 {
+		for iNdEx := len(m.Updated) - 1; iNdEx >= 0; iNdEx-- {
+			size, err := m.Updated[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintStreamRatesStreaming(dAtA, i, uint64(size))
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if m.Snapshot {
+		i--
+		if m.Snapshot {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func encodeVarintStreamRatesStreaming(dAtA []byte, offset int, v uint64) int {
+	offset -= sovStreamRatesStreaming(v)
+	base := offset
+	for v >= 1<<7 {
+		dAtA[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	dAtA[offset] = uint8(v)
+	return base
+}
+
+func (m *StreamRatesUpdate) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Snapshot {
+		n += 2
+	}
+	if len(m.Updated) > 0 {
+		for _, e := range m.Updated {
+			l = e.Size()
+			n += 1 + l + sovStreamRatesStreaming(uint64(l))
+		}
+	}
+	if len(m.Expired) > 0 {
+		l = 0
+		for _, e := range m.Expired {
+			l += sovStreamRatesStreaming(uint64(e))
+		}
+		n += 1 + sovStreamRatesStreaming(uint64(l)) + l
+	}
+	return n
+}
+
+func sovStreamRatesStreaming(x uint64) (n int) {
+	return (bits.Len64(x|1) + 6) / 7
+}
+
+func (m *StreamRatesUpdate) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowStreamRatesStreaming
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: StreamRatesUpdate: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: StreamRatesUpdate: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Snapshot", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStreamRatesStreaming
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Snapshot = v != 0
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Updated", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStreamRatesStreaming
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthStreamRatesStreaming
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthStreamRatesStreaming
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Updated = append(m.Updated, &StreamRate{})
+			if err := m.Updated[len(m.Updated)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType == 0 {
+				var v uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowStreamRatesStreaming
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= uint64(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.Expired = append(m.Expired, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowStreamRatesStreaming
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthStreamRatesStreaming
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthStreamRatesStreaming
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				for iNdEx < postIndex {
+					var v uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowStreamRatesStreaming
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.Expired = append(m.Expired, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field Expired", wireType)
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipStreamRatesStreaming(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthStreamRatesStreaming
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// skipStreamRatesStreaming advances past a single field (of any wire type,
+// including nested groups) without decoding it, for fields this version of
+// StreamRatesUpdate doesn't recognize.
+func skipStreamRatesStreaming(dAtA []byte) (n int, err error) {
+	l := len(dAtA)
+	iNdEx := 0
+	depth := 0
+	for iNdEx < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return 0, ErrIntOverflowStreamRatesStreaming
+			}
+			if iNdEx >= l {
+				return 0, io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		wireType := int(wire & 0x7)
+		switch wireType {
+		case 0:
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return 0, ErrIntOverflowStreamRatesStreaming
+				}
+				if iNdEx >= l {
+					return 0, io.ErrUnexpectedEOF
+				}
+				iNdEx++
+				if dAtA[iNdEx-1] < 0x80 {
+					break
+				}
+			}
+		case 1:
+			iNdEx += 8
+		case 2:
+			var length int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return 0, ErrIntOverflowStreamRatesStreaming
+				}
+				if iNdEx >= l {
+					return 0, io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				length |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if length < 0 {
+				return 0, ErrInvalidLengthStreamRatesStreaming
+			}
+			iNdEx += length
+		case 3:
+			depth++
+		case 4:
+			if depth == 0 {
+				return 0, ErrUnexpectedEndOfGroupStreamRatesStreaming
+			}
+			depth--
+		case 5:
+			iNdEx += 4
+		default:
+			return 0, fmt.Errorf("proto: illegal wireType %d", wireType)
+		}
+		if iNdEx < 0 {
+			return 0, ErrInvalidLengthStreamRatesStreaming
+		}
+		if depth == 0 {
+			return iNdEx, nil
+		}
+	}
+	return 0, io.ErrUnexpectedEOF
+}
+
+var (
+	ErrInvalidLengthStreamRatesStreaming        = fmt.Errorf("proto: negative length found during unmarshaling")
+	ErrIntOverflowStreamRatesStreaming          = fmt.Errorf("proto: integer overflow")
+	ErrUnexpectedEndOfGroupStreamRatesStreaming = fmt.Errorf("proto: unexpected end of group")
+)
+
+// StreamRatesStreamClient is the client side of the server-streaming
+// StreamDataStreaming.StreamStreamRates call.
+type StreamRatesStreamClient interface {
+	Recv() (*StreamRatesUpdate, error)
+	grpc.ClientStream
+}
+
+type streamRatesStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *streamRatesStreamClient) Recv() (*StreamRatesUpdate, error) {
+	m := new(StreamRatesUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StreamRatesStreamServer is the server side of the server-streaming
+// StreamDataStreaming.StreamStreamRates call.
+type StreamRatesStreamServer interface {
+	Send(*StreamRatesUpdate) error
+	grpc.ServerStream
+}
+
+type streamRatesStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *streamRatesStreamServer) Send(m *StreamRatesUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// StreamingStreamDataClient is implemented by ingester clients that
+// support the server-streaming stream-rates RPC in addition to the unary
+// GetStreamRates. Callers should type-assert for this interface and fall
+// back to GetStreamRates when it isn't satisfied, such as against an older
+// ingester that hasn't rolled out the streaming RPC yet.
+type StreamingStreamDataClient interface {
+	StreamDataClient
+
+	StreamStreamRates(ctx context.Context, in *StreamRatesRequest, opts ...grpc.CallOption) (StreamRatesStreamClient, error)
+}
+
+// StreamingStreamDataServer is implemented by ingesters that support the
+// server-streaming stream-rates RPC.
+type StreamingStreamDataServer interface {
+	StreamDataServer
+
+	StreamStreamRates(*StreamRatesRequest, StreamRatesStreamServer) error
+}
+
+// streamDataStreamingClient implements StreamingStreamDataClient by
+// pairing an existing (generated) unary StreamDataClient with the
+// server-streaming StreamStreamRates call, registered as its own service
+// (logproto.StreamDataStreaming) on the same connection so it can be added
+// without regenerating StreamData's own client/descriptor.
+type streamDataStreamingClient struct {
+	StreamDataClient
+	cc grpc.ClientConnInterface
+}
+
+// NewStreamingStreamDataClient wraps base (the generated unary
+// StreamDataClient for cc) with the server-streaming StreamStreamRates
+// call.
+func NewStreamingStreamDataClient(cc grpc.ClientConnInterface, base StreamDataClient) StreamingStreamDataClient {
+	return &streamDataStreamingClient{StreamDataClient: base, cc: cc}
+}
+
+func (c *streamDataStreamingClient) StreamStreamRates(ctx context.Context, in *StreamRatesRequest, opts ...grpc.CallOption) (StreamRatesStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_StreamDataStreaming_serviceDesc.Streams[0], "/logproto.StreamDataStreaming/StreamStreamRates", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &streamRatesStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func _StreamDataStreaming_StreamStreamRates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRatesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StreamingStreamDataServer).StreamStreamRates(m, &streamRatesStreamServer{stream})
+}
+
+var _StreamDataStreaming_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "logproto.StreamDataStreaming",
+	HandlerType: (*StreamingStreamDataServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamStreamRates",
+			Handler:       _StreamDataStreaming_StreamStreamRates_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pkg/logproto/stream_rates_streaming.proto",
+}
+
+// RegisterStreamDataStreamingServer registers srv's streaming
+// StreamStreamRates RPC with s, as the logproto.StreamDataStreaming
+// service distinct from (and alongside) the base StreamData service.
+func RegisterStreamDataStreamingServer(s grpc.ServiceRegistrar, srv StreamingStreamDataServer) {
+	s.RegisterService(&_StreamDataStreaming_serviceDesc, srv)
+}